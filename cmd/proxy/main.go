@@ -8,17 +8,39 @@ See the LICENSE file for further details.
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mlc_goproxy/internal/ca"
 	"mlc_goproxy/internal/config"
 	"mlc_goproxy/internal/proxy"
 	"mlc_goproxy/internal/version"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ca":
+			os.Exit(runCA(os.Args[2:]))
+		case "har":
+			os.Exit(runHARExport(os.Args[2:]))
+		case "client":
+			os.Exit(runClient(os.Args[2:]))
+		}
+	}
+
 	// Command line flags
-	proxyPort := flag.Int("port", 0, "Port for the proxy server (overrides config.ini)")
+	proxyPort := flag.Int("port", 0, "Port of the first proxy listener (overrides config.ini)")
 	showVersion := flag.Bool("version", false, "Show version information and exit")
 	flag.Parse()
 	if *showVersion {
@@ -37,18 +59,258 @@ func main() {
 	}
 
 	// Command line flags override configuration
-	port := config.Cfg.Server.Port
+	if len(config.Cfg.Listeners) == 0 {
+		config.Cfg.Listeners = []config.Listener{config.DefaultListener("", 3128)}
+	}
 	if *proxyPort != 0 {
-		port = *proxyPort
+		config.Cfg.Listeners[0].Port = *proxyPort
 	}
-	// Start proxy server
-	proxyAddr := fmt.Sprintf(":%d", port)
-	log.Printf("Starting proxy server on port %d...", port)
 
-	if err := proxy.Start(proxyAddr); err != nil {
+	// Start proxy server
+	if err := proxy.Start(); err != nil {
 		log.Printf("Error starting proxy server: %v", err)
 		fmt.Println("\nPress any key to exit...")
 		fmt.Scanln()
 		log.Fatal("Terminating program due to error")
 	}
 }
+
+const caUsage = `Usage: mlcproxy ca <command> [options]
+
+Commands:
+  init     create a new signing CA for TLS interception
+  export   write the CA certificate (-format pem|der, -out file)
+  rotate   replace the CA with a new one (old files are kept as .bak)
+`
+
+// runCA implements the "ca" subcommand
+func runCA(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, caUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	certPath := fs.String("cert", "", "CA certificate file (default from config.ini)")
+	keyPath := fs.String("key", "", "CA key file (default from config.ini)")
+	format := fs.String("format", "pem", "Export format: pem or der")
+	out := fs.String("out", "", "Export target file (default stdout)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if err := config.LoadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not load configuration: %v\n", err)
+	}
+	if *certPath == "" {
+		*certPath = config.Cfg.Interception.CACert
+	}
+	if *keyPath == "" {
+		*keyPath = config.Cfg.Interception.CAKey
+	}
+	if *certPath == "" {
+		*certPath = "mlcproxy-ca.pem"
+	}
+	if *keyPath == "" {
+		*keyPath = "mlcproxy-ca.key"
+	}
+
+	var err error
+	switch args[0] {
+	case "init":
+		if err = ca.Init(*certPath, *keyPath); err == nil {
+			fmt.Printf("CA created: %s (key: %s)\n", *certPath, *keyPath)
+		}
+	case "rotate":
+		if err = ca.Rotate(*certPath, *keyPath); err == nil {
+			fmt.Printf("CA rotated: %s (key: %s)\n", *certPath, *keyPath)
+			fmt.Println("Restart the proxy and distribute the new certificate to all clients.")
+		}
+	case "export":
+		var w io.Writer = os.Stdout
+		if *out != "" {
+			f, ferr := os.Create(*out)
+			if ferr != nil {
+				err = ferr
+				break
+			}
+			defer f.Close()
+			w = f
+		}
+		err = ca.Export(w, *certPath, *format)
+	default:
+		fmt.Fprint(os.Stderr, caUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runHARExport implements the "har" subcommand. It downloads the captured
+// traffic from a running proxy instance.
+func runHARExport(args []string) int {
+	fs := flag.NewFlagSet("har", flag.ContinueOnError)
+	proxyAddr := fs.String("proxy", "127.0.0.1:3128", "Address of the running proxy")
+	since := fs.String("since", "", "Export the last duration, e.g. 30m")
+	from := fs.String("from", "", "Start of the time range (RFC 3339)")
+	to := fs.String("to", "", "End of the time range (RFC 3339)")
+	out := fs.String("out", "", "Target file (default stdout)")
+	user := fs.String("user", "", "Admin user name (required)")
+	password := fs.String("password", "", "Admin password (default $MLCPROXY_PASSWORD)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *password == "" {
+		*password = os.Getenv("MLCPROXY_PASSWORD")
+	}
+	if *user == "" {
+		fmt.Fprintln(os.Stderr, "Error: -user is required, the export needs admin credentials")
+		return 2
+	}
+
+	query := url.Values{}
+	for name, value := range map[string]string{"since": *since, "from": *from, "to": *to} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	exportURL := fmt.Sprintf("http://%s/stat/capture.har?%s", *proxyAddr, query.Encode())
+
+	req, err := http.NewRequest(http.MethodGet, exportURL, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	req.SetBasicAuth(*user, *password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "Error: %s: %s", resp.Status, msg)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+const clientUsage = `Usage: mlcproxy client -L [bind:]port:host:hostport [-L ...] -proxy host:port [options]
+
+Opens local ports and tunnels each connection to host:hostport through a
+remote MLCProxy using HTTP CONNECT. Without bind the ports listen on
+127.0.0.1. The proxy may also be given as http[s]://user:password@host:port.
+
+While the proxy is unreachable, new connections are retried for the -retry
+duration. Established tunnels cannot be resumed: if the proxy goes away, the
+local connection is closed and the application has to reconnect.
+
+Options:
+`
+
+// runClient implements the "client" subcommand
+func runClient(args []string) int {
+	var forwards []proxy.ClientForward
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, clientUsage)
+		fs.PrintDefaults()
+	}
+	fs.Func("L", "Local forward [bind:]port:host:hostport (repeatable)", func(spec string) error {
+		fwd, err := proxy.ParseClientForward(spec)
+		if err == nil {
+			forwards = append(forwards, fwd)
+		}
+		return err
+	})
+	proxyAddr := fs.String("proxy", "", "Remote proxy host:port or URL")
+	user := fs.String("user", "", "Proxy user name")
+	password := fs.String("password", "", "Proxy password (default $MLCPROXY_PASSWORD)")
+	useTLS := fs.Bool("tls", false, "Connect to the proxy with TLS (same as an https:// proxy URL)")
+	caFile := fs.String("ca", "", "CA certificate file to verify the proxy (default system roots)")
+	insecure := fs.Bool("insecure", false, "Do not verify the proxy certificate")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout per connection attempt to the proxy")
+	retry := fs.Duration("retry", 30*time.Second, "Keep retrying to open a tunnel this long")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *proxyAddr == "" || len(forwards) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if !strings.Contains(*proxyAddr, "://") {
+		*proxyAddr = "http://" + *proxyAddr
+	}
+	proxyURL, err := url.Parse(*proxyAddr)
+	if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Hostname() == "" {
+		fmt.Fprintf(os.Stderr, "Error: invalid proxy %q\n", *proxyAddr)
+		return 2
+	}
+	if proxyURL.Port() == "" {
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), "3128")
+	}
+	if *useTLS {
+		proxyURL.Scheme = "https"
+	}
+	if proxyURL.User != nil {
+		if *user == "" {
+			*user = proxyURL.User.Username()
+		}
+		if pw, ok := proxyURL.User.Password(); ok && *password == "" {
+			*password = pw
+		}
+	}
+	if *password == "" {
+		*password = os.Getenv("MLCPROXY_PASSWORD")
+	}
+	if *user != "" {
+		proxyURL.User = url.UserPassword(*user, *password)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			fmt.Fprintf(os.Stderr, "Error: no certificates found in %s\n", *caFile)
+			return 1
+		}
+	}
+
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	log.Printf("Starting MLCProxy %s in client mode...", version.GetVersionInfo())
+	err = proxy.RunClient(proxy.ClientOptions{
+		Proxy:       proxyURL,
+		TLS:         tlsConfig,
+		Forwards:    forwards,
+		DialTimeout: *timeout,
+		RetryFor:    *retry,
+	})
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return 1
+}
@@ -2,4 +2,8 @@ module mlc_goproxy
 
 go 1.24.3
 
-require gopkg.in/ini.v1 v1.67.0 // indirect
+require (
+	github.com/andybalholm/brotli v1.2.6
+	golang.org/x/net v0.47.0
+	gopkg.in/ini.v1 v1.67.0
+)
@@ -0,0 +1,285 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+// Package blocklist loads domain blocklists from disk and matches hosts
+// against them. Supported formats are hosts files ("0.0.0.0 ads.example"),
+// plain domain lists and adblock-style rules ("||ads.example^"). An entry
+// blocks the domain and all of its subdomains.
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLists is the number of lists an index can hold (one bit per list)
+const maxLists = 64
+
+// list is a configured source with its parsed exemptions
+type list struct {
+	config.BlocklistSource
+	exempt []*net.IPNet
+}
+
+// index maps every blocked domain to the set of lists containing it
+type index struct {
+	domains map[string]uint64
+	sizes   map[string]int
+}
+
+// Manager holds the loaded lists and reloads them when the files change
+type Manager struct {
+	lists  []*list
+	exempt []*net.IPNet
+	index  atomic.Pointer[index]
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+}
+
+// New loads the enabled lists. exemptClients applies to all lists.
+func New(sources []config.BlocklistSource, exemptClients []string) (*Manager, error) {
+	m := &Manager{modTimes: make(map[string]time.Time)}
+	var err error
+	if m.exempt, err = parseNetworks(exemptClients); err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		if !src.Enabled {
+			continue
+		}
+		if src.File == "" {
+			return nil, fmt.Errorf("blocklist %s: no file configured", src.Name)
+		}
+		l := &list{BlocklistSource: src}
+		if l.exempt, err = parseNetworks(src.ExemptClients); err != nil {
+			return nil, fmt.Errorf("blocklist %s: %w", src.Name, err)
+		}
+		m.lists = append(m.lists, l)
+	}
+	if len(m.lists) > maxLists {
+		return nil, fmt.Errorf("at most %d blocklists are supported", maxLists)
+	}
+	if _, err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload re-reads all lists if one of the files has changed. It reports
+// whether the index has been rebuilt.
+func (m *Manager) Reload() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := m.index.Load() == nil
+	modTimes := make(map[string]time.Time, len(m.lists))
+	for _, l := range m.lists {
+		info, err := os.Stat(l.File)
+		if err != nil {
+			return false, fmt.Errorf("blocklist %s: %w", l.Name, err)
+		}
+		modTimes[l.File] = info.ModTime()
+		if !info.ModTime().Equal(m.modTimes[l.File]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	idx := &index{domains: make(map[string]uint64), sizes: make(map[string]int)}
+	for i, l := range m.lists {
+		n, err := idx.load(l.File, uint64(1)<<i)
+		if err != nil {
+			return false, fmt.Errorf("blocklist %s: %w", l.Name, err)
+		}
+		idx.sizes[l.Name] = n
+	}
+	m.index.Store(idx)
+	m.modTimes = modTimes
+	return true, nil
+}
+
+// Watch checks the files for changes every interval until the process exits
+func (m *Manager) Watch(interval time.Duration) {
+	if m == nil || interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			reloaded, err := m.Reload()
+			if err != nil {
+				log.Printf("Blocklist reload failed, keeping previous lists: %v", err)
+			} else if reloaded {
+				log.Printf("Blocklists reloaded: %d domains", m.Len())
+			}
+		}
+	}()
+}
+
+// Match returns the name of the first list blocking host for the client, or
+// "" if the host is not blocked. It is safe to call on a nil Manager.
+func (m *Manager) Match(clientIP, host string) string {
+	if m == nil {
+		return ""
+	}
+	idx := m.index.Load()
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	// Collect the lists containing the host or one of its parent domains
+	var mask uint64
+	for name := host; name != ""; {
+		mask |= idx.domains[name]
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			break
+		}
+		name = name[dot+1:]
+	}
+	if mask == 0 {
+		return ""
+	}
+
+	ip := net.ParseIP(strings.Trim(clientIP, "[]"))
+	if containsIP(m.exempt, ip) {
+		return ""
+	}
+	for i, l := range m.lists {
+		if mask&(uint64(1)<<i) != 0 && !containsIP(l.exempt, ip) {
+			return l.Name
+		}
+	}
+	return ""
+}
+
+// Len returns the number of distinct blocked domains
+func (m *Manager) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.index.Load().domains)
+}
+
+// Sizes returns the number of entries per list
+func (m *Manager) Sizes() map[string]int {
+	if m == nil {
+		return nil
+	}
+	return m.index.Load().sizes
+}
+
+// load adds the domains of one file to the index and returns their number
+func (idx *index) load(path string, bit uint64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		for _, domain := range parseLine(scanner.Text()) {
+			idx.domains[domain] |= bit
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
+
+// parseLine returns the domains of one line in any of the supported formats
+func parseLine(line string) []string {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' {
+		return nil
+	}
+
+	// Adblock syntax: only plain domain rules are supported
+	if rule, ok := strings.CutPrefix(line, "||"); ok {
+		domain, _, _ := strings.Cut(rule, "^")
+		if strings.ContainsAny(domain, "/*$") {
+			return nil
+		}
+		return validDomains([]string{domain})
+	}
+
+	if comment := strings.IndexByte(line, '#'); comment >= 0 {
+		line = line[:comment]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	// Hosts format: address followed by one or more names
+	if net.ParseIP(fields[0]) != nil {
+		return validDomains(fields[1:])
+	}
+	return validDomains(fields[:1])
+}
+
+// validDomains normalizes names and drops entries that must never be blocked
+func validDomains(names []string) []string {
+	var domains []string
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "*"), ".")
+		switch name {
+		case "", "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+			continue
+		}
+		if !strings.Contains(name, ".") || strings.ContainsAny(name, "/:@ ") || net.ParseIP(name) != nil {
+			continue
+		}
+		domains = append(domains, name)
+	}
+	return domains
+}
+
+// parseNetworks parses IPs and CIDR networks
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client network %q", entry)
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
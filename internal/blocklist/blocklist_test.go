@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package blocklist
+
+import (
+	"mlc_goproxy/internal/config"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		// Plain domain lists
+		{line: "ads.example.com", want: []string{"ads.example.com"}},
+		{line: "  Ads.Example.COM.  ", want: []string{"ads.example.com"}},
+		{line: "*.tracker.example", want: []string{"tracker.example"}},
+		{line: ".tracker.example", want: []string{"tracker.example"}},
+		{line: "ads.example.com # comment", want: []string{"ads.example.com"}},
+		{line: "ads.example.com second.example", want: []string{"ads.example.com"}},
+		// Hosts files
+		{line: "0.0.0.0 ads.example.com", want: []string{"ads.example.com"}},
+		{line: "127.0.0.1\tads.example.com tracker.example\t# both", want: []string{"ads.example.com", "tracker.example"}},
+		{line: ":: ads.example.com", want: []string{"ads.example.com"}},
+		{line: "127.0.0.1 localhost", want: nil},
+		{line: "::1 ip6-localhost ip6-loopback", want: nil},
+		{line: "255.255.255.255 broadcasthost", want: nil},
+		{line: "0.0.0.0 0.0.0.0", want: nil},
+		{line: "0.0.0.0", want: nil},
+		// Adblock rules
+		{line: "||ads.example.com^", want: []string{"ads.example.com"}},
+		{line: "||ads.example.com^$third-party", want: []string{"ads.example.com"}},
+		{line: "||ads.example.com", want: []string{"ads.example.com"}},
+		{line: "||ads.example.com/banner^", want: nil},
+		{line: "||ads*.example.com^", want: nil},
+		{line: "@@||good.example.com^", want: nil},
+		{line: "! Title: comment", want: nil},
+		{line: "[Adblock Plus 2.0]", want: nil},
+		// Neither
+		{line: "", want: nil},
+		{line: "# comment", want: nil},
+		{line: "intranet", want: nil},
+		{line: "https://ads.example.com/", want: nil},
+		{line: "user@example.com", want: nil},
+		{line: "192.0.2.1", want: nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.line, func(t *testing.T) {
+			if got := parseLine(tc.line); !slices.Equal(got, tc.want) {
+				t.Errorf("parseLine(%q) = %q, want %q", tc.line, got, tc.want)
+			}
+		})
+	}
+}
+
+func writeList(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	m, err := New([]config.BlocklistSource{
+		{Name: "ads", Enabled: true, File: writeList(t, dir, "ads.txt", "0.0.0.0 ads.example.com\n||tracker.example^\n"),
+			ExemptClients: []string{"192.168.1.0/24"}},
+		{Name: "malware", Enabled: true, File: writeList(t, dir, "malware.txt", "evil.example\ntracker.example\n")},
+		{Name: "disabled", Enabled: false, File: filepath.Join(dir, "missing.txt")},
+	}, []string{"10.0.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		client string
+		host   string
+		want   string
+	}{
+		{name: "listed", client: "192.0.2.1", host: "ads.example.com", want: "ads"},
+		{name: "subdomain", client: "192.0.2.1", host: "img.ads.example.com", want: "ads"},
+		{name: "case and trailing dot", client: "192.0.2.1", host: "IMG.Ads.Example.com.", want: "ads"},
+		{name: "parent not blocked", client: "192.0.2.1", host: "example.com", want: ""},
+		{name: "similar name", client: "192.0.2.1", host: "notads.example.com", want: ""},
+		{name: "first list wins", client: "192.0.2.1", host: "tracker.example", want: "ads"},
+		{name: "exempt from one list", client: "192.168.1.20", host: "tracker.example", want: "malware"},
+		{name: "exempt from the only list", client: "192.168.1.20", host: "ads.example.com", want: ""},
+		{name: "exempt from all lists", client: "10.0.0.5", host: "evil.example", want: ""},
+		{name: "bracketed IPv6 client", client: "[2001:db8::1]", host: "evil.example", want: "malware"},
+		{name: "not listed", client: "192.0.2.1", host: "www.example.org", want: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := m.Match(tc.client, tc.host); got != tc.want {
+				t.Errorf("Match(%s, %s) = %q, want %q", tc.client, tc.host, got, tc.want)
+			}
+		})
+	}
+
+	if n := m.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3 distinct domains", n)
+	}
+	if sizes := m.Sizes(); sizes["ads"] != 2 || sizes["malware"] != 2 {
+		t.Errorf("Sizes() = %v", sizes)
+	}
+	var none *Manager
+	if got := none.Match("192.0.2.1", "ads.example.com"); got != "" {
+		t.Errorf("nil Manager matched %q", got)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeList(t, dir, "ads.txt", "ads.example.com\n")
+	m, err := New([]config.BlocklistSource{{Name: "ads", Enabled: true, File: path}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := m.Reload(); reloaded || err != nil {
+		t.Errorf("Reload without changes = %v, %v", reloaded, err)
+	}
+
+	writeList(t, dir, "ads.txt", "tracker.example\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := m.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload after a change = %v, %v", reloaded, err)
+	}
+	if m.Match("192.0.2.1", "ads.example.com") != "" || m.Match("192.0.2.1", "tracker.example") != "ads" {
+		t.Error("index not rebuilt from the changed file")
+	}
+
+	// A failing reload keeps the previous index
+	os.Remove(path)
+	if _, err := m.Reload(); err == nil {
+		t.Error("Reload of a missing file succeeded")
+	}
+	if m.Match("192.0.2.1", "tracker.example") != "ads" {
+		t.Error("previous index lost after a failed reload")
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+// Package ca manages the signing CA used for TLS interception and mints
+// short-lived leaf certificates for intercepted hosts.
+package ca
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caValidity is the lifetime of a newly created signing CA
+const caValidity = 10 * 365 * 24 * time.Hour
+
+// renewBefore is the remaining lifetime below which a cached leaf is re-minted
+const renewBefore = time.Hour
+
+// maxLeaves limits the cached leaf certificates. Clients choose the host
+// names, so the least recently used leaves are dropped beyond that.
+const maxLeaves = 1000
+
+// ErrExists is returned by Init if a CA certificate or key is already present
+var ErrExists = errors.New("CA already exists")
+
+// Authority is a loaded signing CA together with its leaf certificate cache
+type Authority struct {
+	cert         *x509.Certificate
+	key          *ecdsa.PrivateKey
+	leafValidity time.Duration
+
+	mu        sync.Mutex
+	leaves    map[string]*list.Element // host -> *cachedLeaf in lru
+	lru       *list.List               // most recently used first
+	maxLeaves int
+	minting   map[string]*mintCall // hosts a leaf is being minted for
+}
+
+type cachedLeaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+// mintCall is a running mint; concurrent handshakes for the same host wait
+// for it instead of minting their own leaf
+type mintCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// Init creates a new CA and writes certificate and key to the given paths.
+// Existing files are never overwritten; use Rotate to replace a CA.
+func Init(certPath, keyPath string) error {
+	for _, p := range []string{certPath, keyPath} {
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("%w: %s", ErrExists, p)
+		}
+	}
+	return create(certPath, keyPath)
+}
+
+// Rotate moves the current CA files aside (suffix .<timestamp>.bak) and
+// creates a fresh CA in their place. Clients must import the new certificate.
+func Rotate(certPath, keyPath string) error {
+	suffix := "." + time.Now().Format("20060102-150405") + ".bak"
+	for _, p := range []string{certPath, keyPath} {
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if err := os.Rename(p, p+suffix); err != nil {
+			return fmt.Errorf("backup %s: %w", p, err)
+		}
+	}
+	return create(certPath, keyPath)
+}
+
+// Export writes the CA certificate to w, either as "pem" or "der"
+func Export(w io.Writer, certPath, format string) error {
+	cert, err := readCert(certPath)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(format) {
+	case "", "pem":
+		return pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	case "der":
+		_, err = w.Write(cert.Raw)
+		return err
+	default:
+		return fmt.Errorf("unknown export format %q (pem or der)", format)
+	}
+}
+
+// Load reads an existing CA from disk. leafValidity sets the lifetime of
+// minted leaf certificates.
+func Load(certPath, keyPath string, leafValidity time.Duration) (*Authority, error) {
+	cert, err := readCert(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA key: %w", err)
+	}
+	if leafValidity <= renewBefore {
+		leafValidity = 24 * time.Hour
+	}
+	return &Authority{
+		cert:         cert,
+		key:          key,
+		leafValidity: leafValidity,
+		leaves:       make(map[string]*list.Element),
+		lru:          list.New(),
+		maxLeaves:    maxLeaves,
+		minting:      make(map[string]*mintCall),
+	}, nil
+}
+
+// Certificate returns the CA certificate
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// LeafFor returns a leaf certificate for host, minting a new one if none is
+// cached or the cached one is about to expire. Minting runs outside the
+// cache lock, so handshakes for other hosts are not held up.
+func (a *Authority) LeafFor(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	a.mu.Lock()
+	if e, ok := a.leaves[host]; ok {
+		if leaf := e.Value.(*cachedLeaf).cert; time.Until(leaf.Leaf.NotAfter) > renewBefore {
+			a.lru.MoveToFront(e)
+			a.mu.Unlock()
+			return leaf, nil
+		}
+	}
+	if call, ok := a.minting[host]; ok {
+		a.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	call := &mintCall{done: make(chan struct{})}
+	a.minting[host] = call
+	a.mu.Unlock()
+
+	call.cert, call.err = a.mint(host)
+
+	a.mu.Lock()
+	delete(a.minting, host)
+	if call.err == nil {
+		a.storeLocked(host, call.cert)
+	}
+	a.mu.Unlock()
+	close(call.done)
+	return call.cert, call.err
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate. fallbackHost is
+// used when the client sends no SNI.
+func (a *Authority) GetCertificate(fallbackHost string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		host := hello.ServerName
+		if host == "" {
+			host = fallbackHost
+		}
+		return a.LeafFor(host)
+	}
+}
+
+// mint creates a new leaf certificate signed by the CA
+func (a *Authority) mint(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(a.leafValidity)
+	if notAfter.After(a.cert.NotAfter) {
+		notAfter = a.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// storeLocked caches the leaf of host and drops the least recently used
+// leaf if the cache is full. Caller holds a.mu.
+func (a *Authority) storeLocked(host string, leaf *tls.Certificate) {
+	if e, ok := a.leaves[host]; ok {
+		e.Value.(*cachedLeaf).cert = leaf
+		a.lru.MoveToFront(e)
+		return
+	}
+	a.leaves[host] = a.lru.PushFront(&cachedLeaf{host: host, cert: leaf})
+	if a.lru.Len() > a.maxLeaves {
+		oldest := a.lru.Remove(a.lru.Back()).(*cachedLeaf)
+		delete(a.leaves, oldest.host)
+	}
+}
+
+// create generates a new self-signed CA and stores it
+func create(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "MLCProxy CA " + hostname,
+			Organization: []string{"MLCProxy"},
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", der, 0644)
+}
+
+// readCert loads a PEM encoded certificate from disk
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package ca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestAuthority(t *testing.T) *Authority {
+	t.Helper()
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	if err := Init(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Load(certPath, keyPath, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestLeafFor(t *testing.T) {
+	a := newTestAuthority(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Certificate())
+
+	for _, host := range []string{"www.example.com", "192.0.2.1", "2001:db8::1"} {
+		leaf, err := a.LeafFor(host)
+		if err != nil {
+			t.Fatalf("LeafFor(%s): %v", host, err)
+		}
+		if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("leaf for %s does not verify: %v", host, err)
+		}
+	}
+
+	first, _ := a.LeafFor("www.example.com")
+	if again, _ := a.LeafFor("WWW.Example.com."); again != first {
+		t.Error("leaf was minted again instead of taken from the cache")
+	}
+
+	// A leaf about to expire is replaced
+	first.Leaf.NotAfter = time.Now().Add(renewBefore / 2)
+	if renewed, _ := a.LeafFor("www.example.com"); renewed == first {
+		t.Error("leaf close to expiry was not renewed")
+	}
+}
+
+func TestLeafCacheLimit(t *testing.T) {
+	a := newTestAuthority(t)
+	a.maxLeaves = 2
+
+	leafA, _ := a.LeafFor("a.example")
+	a.LeafFor("b.example")
+	a.LeafFor("a.example") // a is now used more recently than b
+	a.LeafFor("c.example")
+
+	if len(a.leaves) != 2 || a.lru.Len() != 2 {
+		t.Fatalf("cache holds %d/%d leaves, want 2", len(a.leaves), a.lru.Len())
+	}
+	if _, ok := a.leaves["b.example"]; ok {
+		t.Error("least recently used leaf b.example was not dropped")
+	}
+	if leaf, _ := a.LeafFor("a.example"); leaf != leafA {
+		t.Error("recently used leaf a.example was dropped")
+	}
+}
+
+func TestLeafForConcurrent(t *testing.T) {
+	a := newTestAuthority(t)
+
+	// Concurrent handshakes for one host share a single mint
+	var wg sync.WaitGroup
+	leaves := make([]*tls.Certificate, 16)
+	for i := range leaves {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leaf, err := a.LeafFor("shared.example")
+			if err != nil {
+				t.Error(err)
+			}
+			leaves[i] = leaf
+		}()
+	}
+	wg.Wait()
+	for _, leaf := range leaves[1:] {
+		if leaf != leaves[0] {
+			t.Fatal("concurrent calls minted different leaves")
+		}
+	}
+	if len(a.minting) != 0 {
+		t.Errorf("%d mints still registered", len(a.minting))
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+// Package capture records HTTP exchanges passing through the proxy and
+// exports them as HAR 1.2 files.
+package capture
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is one recorded request/response exchange
+type Entry struct {
+	Started        time.Time
+	ClientIP       string
+	ServerAddr     string
+	Method         string
+	URL            string
+	Proto          string
+	RequestHeader  http.Header
+	RequestBody    []byte
+	RequestSize    int64
+	Status         int
+	StatusText     string
+	ResponseProto  string
+	ResponseHeader http.Header
+	ResponseBody   []byte
+	ResponseSize   int64
+	Truncated      bool // a body exceeded the size limit
+	Send           time.Duration
+	Wait           time.Duration
+	Receive        time.Duration
+}
+
+// Recorder keeps the most recent entries in memory
+type Recorder struct {
+	mu         sync.RWMutex
+	entries    []*Entry
+	maxEntries int
+	maxBody    int
+}
+
+// NewRecorder creates a recorder holding up to maxEntries exchanges with
+// bodies cut off after maxBody bytes
+func NewRecorder(maxEntries, maxBody int) *Recorder {
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	return &Recorder{maxEntries: maxEntries, maxBody: maxBody}
+}
+
+// MaxBody returns the body size limit in bytes
+func (r *Recorder) MaxBody() int {
+	return r.maxBody
+}
+
+// Add stores an entry, dropping the oldest one if the recorder is full
+func (r *Recorder) Add(e *Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) >= r.maxEntries {
+		r.entries = append(r.entries[1:], e)
+	} else {
+		r.entries = append(r.entries, e)
+	}
+}
+
+// Entries returns all entries started within [from, to]. Zero times are
+// treated as open bounds.
+func (r *Recorder) Entries(from, to time.Time) []*Entry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var result []*Entry
+	for _, e := range r.entries {
+		if !from.IsZero() && e.Started.Before(from) {
+			continue
+		}
+		if !to.IsZero() && e.Started.After(to) {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// LimitedBuffer collects up to a fixed number of bytes and remembers
+// whether more data was offered. It is used as a tee target for bodies.
+type LimitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	Truncated bool
+}
+
+// NewLimitedBuffer creates a buffer accepting up to limit bytes
+func NewLimitedBuffer(limit int) *LimitedBuffer {
+	return &LimitedBuffer{limit: limit}
+}
+
+// Write implements io.Writer and never fails, so it can be used with io.TeeReader
+func (b *LimitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+			b.Truncated = true
+		} else {
+			b.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		b.Truncated = true
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of the collected data
+func (b *LimitedBuffer) Bytes() []byte {
+	return append([]byte(nil), b.buf.Bytes()...)
+}
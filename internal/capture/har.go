@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package capture
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mlc_goproxy/internal/version"
+	"net/url"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	ClientIP        string      `json:"_clientIP,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// WriteHAR writes the given entries as HAR 1.2 document
+func WriteHAR(w io.Writer, entries []*Entry) error {
+	file := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "MLCProxy", Version: version.Version},
+		Entries: make([]harEntry, 0, len(entries)),
+	}}
+	for _, e := range entries {
+		file.Log.Entries = append(file.Log.Entries, toHAR(e))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(file)
+}
+
+func toHAR(e *Entry) harEntry {
+	he := harEntry{
+		StartedDateTime: e.Started.Format(time.RFC3339Nano),
+		Time:            ms(e.Send + e.Wait + e.Receive),
+		ServerIPAddress: e.ServerAddr,
+		ClientIP:        e.ClientIP,
+		Timings:         harTimings{Send: ms(e.Send), Wait: ms(e.Wait), Receive: ms(e.Receive)},
+		Request: harRequest{
+			Method:      e.Method,
+			URL:         e.URL,
+			HTTPVersion: e.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.RequestHeader),
+			QueryString: harQuery(e.URL),
+			HeadersSize: -1,
+			BodySize:    e.RequestSize,
+		},
+		Response: harResponse{
+			Status:      e.Status,
+			StatusText:  e.StatusText,
+			HTTPVersion: e.ResponseProto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.ResponseHeader),
+			RedirectURL: e.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    e.ResponseSize,
+		},
+	}
+	if e.Truncated {
+		he.Comment = "body truncated by MLCProxy capture limit"
+	}
+
+	if len(e.RequestBody) > 0 {
+		text, encoding := bodyText(e.RequestBody)
+		he.Request.PostData = &harPostData{
+			MimeType: e.RequestHeader.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		}
+	}
+
+	he.Response.Content = harContent{
+		Size:     e.ResponseSize,
+		MimeType: e.ResponseHeader.Get("Content-Type"),
+	}
+	if len(e.ResponseBody) > 0 {
+		// Compressed bodies are stored as received and therefore base64 encoded
+		if e.ResponseHeader.Get("Content-Encoding") != "" {
+			he.Response.Content.Text = base64.StdEncoding.EncodeToString(e.ResponseBody)
+			he.Response.Content.Encoding = "base64"
+		} else {
+			he.Response.Content.Text, he.Response.Content.Encoding = bodyText(e.ResponseBody)
+		}
+	}
+	return he
+}
+
+// bodyText returns the body as text, or base64 encoded if it is binary
+func bodyText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harHeaders(h map[string][]string) []harNameValue {
+	result := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			result = append(result, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func harQuery(rawURL string) []harNameValue {
+	result := []harNameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return result
+	}
+	for name, values := range u.Query() {
+		for _, v := range values {
+			result = append(result, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+// Package cassette stores recorded upstream responses on disk so they can be
+// replayed without network access.
+package cassette
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Replay modes
+const (
+	ModeOff    = "off"    // cassettes are not used
+	ModeRecord = "record" // always forward and store the responses
+	ModeReplay = "replay" // strict: serve from cassettes, 502 on a miss
+	ModeHybrid = "hybrid" // serve from cassettes, forward and record misses
+)
+
+// ErrNotFound is returned by Lookup if no recording matches
+var ErrNotFound = errors.New("no matching recording")
+
+// Recording is one stored exchange
+type Recording struct {
+	RecordedAt time.Time         `json:"recorded_at"`
+	Method     string            `json:"method"`
+	URL        string            `json:"url"`
+	Match      map[string]string `json:"match_headers,omitempty"`
+	Status     int               `json:"status"`
+	Header     http.Header       `json:"header"`
+	Body       []byte            `json:"body"`
+}
+
+// Store is a cassette directory
+type Store struct {
+	dir          string
+	matchHeaders []string
+}
+
+// NewStore opens (and creates) the cassette directory. matchHeaders lists
+// the request headers that take part in matching besides method and URL.
+func NewStore(dir string, matchHeaders []string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	headers := make([]string, 0, len(matchHeaders))
+	for _, h := range matchHeaders {
+		headers = append(headers, http.CanonicalHeaderKey(h))
+	}
+	sort.Strings(headers)
+	return &Store{dir: dir, matchHeaders: headers}, nil
+}
+
+// Lookup returns the recording matching method, URL and match headers
+func (s *Store) Lookup(method, url string, header http.Header) (*Recording, error) {
+	data, err := os.ReadFile(s.path(method, url, header))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Save stores a response, replacing an older recording of the same request
+func (s *Store) Save(method, url string, reqHeader http.Header, status int, respHeader http.Header, body []byte) error {
+	rec := Recording{
+		RecordedAt: time.Now(),
+		Method:     method,
+		URL:        url,
+		Match:      s.matchValues(reqHeader),
+		Status:     status,
+		Header:     respHeader,
+		Body:       body,
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := s.path(method, url, reqHeader)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write to a temp file first so a concurrent replay never sees half a
+	// file. Every save gets its own, concurrent saves of the same request
+	// must not write into each other's file.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after the rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// matchValues extracts the configured match headers from h
+func (s *Store) matchValues(h http.Header) map[string]string {
+	if len(s.matchHeaders) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(s.matchHeaders))
+	for _, name := range s.matchHeaders {
+		values[name] = strings.Join(h.Values(name), ",")
+	}
+	return values
+}
+
+// path returns the file of a recording: <dir>/<host>/<sha256>.json
+func (s *Store) path(method, url string, h http.Header) string {
+	sum := sha256.New()
+	sum.Write([]byte(method + " " + url + "\n"))
+	for _, name := range s.matchHeaders {
+		sum.Write([]byte(name + ": " + strings.Join(h.Values(name), ",") + "\n"))
+	}
+	return filepath.Join(s.dir, hostDir(url), hex.EncodeToString(sum.Sum(nil))+".json")
+}
+
+// hostDir derives a filesystem-safe directory name from the URL's host
+func hostDir(url string) string {
+	host := url
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.NewReplacer(":", "_", "\\", "_", "..", "_").Replace(host)
+	if host == "" {
+		host = "_"
+	}
+	return host
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package cassette
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSaveLookup(t *testing.T) {
+	s, err := NewStore(t.TempDir(), []string{"accept-language"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	de := http.Header{"Accept-Language": {"de"}}
+	en := http.Header{"Accept-Language": {"en"}}
+	if err := s.Save("GET", "http://example.com/a", de, 200, http.Header{"Content-Type": {"text/plain"}}, []byte("hallo")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := s.Lookup("GET", "http://example.com/a", de)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != 200 || string(rec.Body) != "hallo" || rec.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("got status %d body %q header %v", rec.Status, rec.Body, rec.Header)
+	}
+	for _, miss := range []struct {
+		method, url string
+		header      http.Header
+	}{
+		{"POST", "http://example.com/a", de},
+		{"GET", "http://example.com/b", de},
+		{"GET", "http://example.com/a", en},
+	} {
+		if _, err := s.Lookup(miss.method, miss.url, miss.header); err != ErrNotFound {
+			t.Errorf("Lookup(%s %s %v) = %v, want ErrNotFound", miss.method, miss.url, miss.header, err)
+		}
+	}
+}
+
+func TestConcurrentSave(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Saves of the same request must not corrupt each other's file
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := []byte(strings.Repeat(string(rune('a'+i)), 10000))
+			errs <- s.Save("GET", "http://example.com/", nil, 200, nil, body)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	rec, err := s.Lookup("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("Lookup after concurrent saves: %v", err)
+	}
+	if len(rec.Body) == 0 || strings.Trim(string(rec.Body), string(rec.Body[:1])) != "" {
+		t.Errorf("body mixes several saves: %.40q...", rec.Body)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Ext(files[0]) != ".json" {
+		t.Errorf("cassette directory contains %v, want a single recording", files)
+	}
+	if info, err := os.Stat(files[0]); err == nil && info.Mode().Perm() != 0644 {
+		t.Errorf("recording has mode %v, want 0644", info.Mode().Perm())
+	}
+}
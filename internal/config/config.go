@@ -9,18 +9,20 @@ package config
 
 import (
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/ini.v1"
 )
 
 type Config struct {
-	Server struct {
-		Port int
-	}
-	Paths struct {
+	Listeners []Listener
+	Forwards  []Forward
+	Paths     struct {
 		StaticDir string
 		StatsPath string
 		APIPath   string
@@ -28,15 +30,274 @@ type Config struct {
 	Features struct {
 		StatsHost string
 	}
+	PAC struct {
+		DirectHosts    []string // Host-Muster, die ohne Proxy erreicht werden
+		DirectNetworks []string // IPv4-Netze (CIDR), die ohne Proxy erreicht werden
+	}
 	Auth struct {
 		EnableAuth  bool
 		Credentials map[string]string // username -> password
 	}
 	Security struct {
-		AllowedNetworks []string
+		AllowedNetworks     []string
+		AllowedDestinations []string // leer = alle Ziele erlaubt
+		DeniedDestinations  []string
+		PeekSNI             bool
+	}
+	Interception struct {
+		Enabled      bool
+		CACert       string
+		CAKey        string
+		LeafValidity time.Duration
+	}
+	Capture struct {
+		Enabled     bool
+		Clients     []string // IPs oder CIDR-Netze, leer = alle
+		Hosts       []string // Host-Muster, leer = alle
+		MaxEntries  int
+		MaxBodySize int
+	}
+	Replay struct {
+		Mode         string // off, record, replay, hybrid
+		CassetteDir  string
+		MatchHeaders []string
+		MaxBodySize  int
+	}
+	Chaos struct {
+		Enabled bool
+		Rules   []ChaosRule
+	}
+	Mock struct {
+		Rules []MockRule
+	}
+	Rewrite struct {
+		Rules []RewriteRule
+	}
+	Reverse struct {
+		Sites []ReverseSite
+	}
+	Filter struct {
+		BlockedTypes    []string // MIME-Typen, "application/*" erlaubt
+		MaxResponseSize int64    // Bytes, 0 = unbegrenzt
+		MaxRewriteSize  int      // größere Antworten mit passender Regel werden blockiert
+		Rules           []FilterRule
+	}
+	ICAP struct {
+		Enabled        bool
+		ReqModURL      string // icap://host:1344/reqmod, leer = kein REQMOD
+		RespModURL     string // icap://host:1344/respmod, leer = kein RESPMOD
+		Preview        int    // Preview-Größe in Bytes, -1 = ohne Preview
+		Timeout        time.Duration
+		FailPolicy     string // open oder closed
+		MaxBodySize    int    // größere Bodies werden nicht gescannt
+		OversizePolicy string // skip oder block für Bodies über MaxBodySize
+		BypassHosts    []string
+	}
+	Blocklist struct {
+		ReloadInterval time.Duration // 0 = nicht neu laden
+		ExemptClients  []string      // IPs oder CIDR-Netze, für alle Listen ausgenommen
+		Lists          []BlocklistSource
+	}
+	Resolver struct {
+		Enabled       bool
+		Servers       []string            // Standard-DNS-Server, leer = System-Resolver
+		DomainServers map[string][]string // Domain (inkl. Subdomains) -> DNS-Server
+		Hosts         map[string][]string // feste Zuordnung Host -> IP-Adressen
+		Timeout       time.Duration
+		CacheTTL      time.Duration // Cache-Dauer für Antworten des System-Resolvers
+		MaxTTL        time.Duration // Obergrenze für TTLs aus DNS-Antworten
+		CAFile        string        // zusätzliche Root-CAs für DoH-/DoT-Server
+	}
+	DNS struct {
+		Enabled       bool
+		Listen        string // Adresse für UDP und TCP, z.B. :53
+		BlockedAnswer string // zero oder nxdomain
+	}
+	// Rendezvous nimmt Verbindungen von Agents an; Listener mit agent = <name>
+	// leiten ihren ausgehenden Verkehr über diese Verbindung
+	Rendezvous struct {
+		Enabled bool
+		Listen  string
+		TLSCert string // leer = ohne TLS
+		TLSKey  string
+		Tokens  map[string]string // Agent-Name -> Token
+	}
+	// Agent verbindet sich zu einem Rendezvous-Proxy (z.B. hinter NAT) und
+	// baut die dort angefragten Verbindungen von hier aus auf
+	Agent struct {
+		Enabled           bool
+		Server            string // host:port des Rendezvous-Proxys
+		Name              string
+		Token             string
+		TLS               bool
+		CAFile            string // CA für das Zertifikat des Rendezvous-Proxys, leer = System
+		MaxReconnectDelay time.Duration
+	}
+	Outbound struct {
+		SourceIP  string // Quelladresse für Verbindungen zu Zielservern
+		Interface string // Netzwerk-Interface (nur Linux, SO_BINDTODEVICE)
+		Routes    []OutboundRoute
+
+		// Happy Eyeballs (RFC 8305)
+		IPPreference   string        // prefer-v6, prefer-v4, ipv4-only oder ipv6-only
+		AttemptDelay   time.Duration // Vorsprung eines Versuchs vor dem nächsten
+		AttemptTimeout time.Duration // Zeitlimit pro Verbindungsversuch
+		ConnectTimeout time.Duration // Zeitlimit für den gesamten Verbindungsaufbau
+
+		// PROXY-Protokoll-Header für Tunnel zu diesen Zielen senden
+		ProxyProtocolHosts   []string // Host-Muster, leer = keine
+		ProxyProtocolVersion int      // 1 oder 2
 	}
 }
 
+// Listener ist ein Proxy-Port mit eigener Zugriffsregelung
+type Listener struct {
+	Name            string
+	Enabled         bool
+	Bind            string // Adresse, leer = alle Interfaces
+	Port            int
+	Protocol        string   // http, https oder transparent
+	Auth            string   // global (Einstellung aus [auth]), basic, cert oder none
+	TProxy          bool     // transparent: Verbindungen per iptables TPROXY statt REDIRECT
+	AllowedNetworks []string // leer = allowed_networks aus [security]
+	Routes          []string // Namen der [outbound.<name>]-Routen, leer = alle
+	Agent           string   // Ausgehender Verkehr über diesen Agent (siehe [rendezvous])
+
+	// PROXY-Protokoll (v1/v2) vor z.B. HAProxy: die Client-Adresse kommt aus
+	// dem Header, der nur von ProxyProtocolFrom angenommen wird
+	ProxyProtocol     bool
+	ProxyProtocolFrom []string // vertrauenswürdige Absender (IPs oder CIDR-Netze)
+
+	// Nur für protocol = https
+	TLSCert   string            // Zertifikat (PEM), wird bei Änderung neu geladen
+	TLSKey    string            // privater Schlüssel (PEM)
+	ClientCA  string            // CA für Client-Zertifikate (PEM), nötig für auth = cert
+	CertUsers map[string]string // Common Name -> Benutzer, leer = Common Name
+}
+
+// DefaultListener ist der Listener, wenn keine [listener.<name>]-Sektionen
+// konfiguriert sind
+func DefaultListener(bind string, port int) Listener {
+	return Listener{Name: "default", Enabled: true, Bind: bind, Port: port, Protocol: "http", Auth: "global"}
+}
+
+// Addr liefert die Adresse für net.Listen
+func (l Listener) Addr() string {
+	return net.JoinHostPort(l.Bind, strconv.Itoa(l.Port))
+}
+
+// OutboundRoute legt Quelladresse/Interface für passende Ziele oder Benutzer fest
+type OutboundRoute struct {
+	Name      string
+	Enabled   bool
+	Hosts     []string // Host-Muster, leer = alle
+	Users     []string // Proxy-Benutzer, leer = alle
+	SourceIP  string
+	Interface string
+}
+
+// BlocklistSource ist eine Datei im hosts-Format, eine Domainliste oder eine
+// Liste mit Adblock-Regeln der Form ||domain^
+type BlocklistSource struct {
+	Name          string
+	Enabled       bool
+	File          string
+	ExemptClients []string // IPs oder CIDR-Netze, für diese Liste ausgenommen
+}
+
+// FilterRule ersetzt Text in Antwort-Bodies passender Content-Types
+type FilterRule struct {
+	Name         string
+	Enabled      bool
+	Hosts        []string // Host-Muster, leer = alle
+	ContentTypes []string // z.B. text/html, leer = alle
+	Replace      []string // "<regulärer Ausdruck> => <Ersetzung>" in Reihenfolge
+}
+
+// RewriteRule beschreibt Header- und URL-Umschreibungen für passende Anfragen
+type RewriteRule struct {
+	Name         string
+	Enabled      bool
+	Hosts        []string // Host-Muster, leer = alle
+	PathPrefix   string
+	Request      HeaderRewrite
+	Response     HeaderRewrite
+	URLRewrite   string // "<regulärer Ausdruck> => <Ersetzung>" auf die vollständige URL
+	RedirectHost string // Anfrage an diesen Host[:Port] umleiten
+	PreserveHost bool   // Host-Header bei RedirectHost beibehalten
+}
+
+// ReverseSite veröffentlicht Backends für Anfragen an eigene Hostnamen
+// (Reverse-Proxy). Anfragen unter PathPrefix gehen an die Backend-URL, deren
+// Pfad das Präfix ersetzt.
+type ReverseSite struct {
+	Name            string
+	Enabled         bool
+	Hosts           []string // Host-Muster
+	PathPrefix      string   // öffentliches Pfad-Präfix, Standard /
+	Backends        []string // Backend-URLs, abwechselnd genutzt
+	PreserveHost    bool     // Host-Header des Clients an das Backend senden
+	AllowedNetworks []string // leer = Netze des Listeners
+	Request         HeaderRewrite
+	Response        HeaderRewrite
+	HealthCheck     string // Pfad für Health-Checks, leer = keine
+	HealthInterval  time.Duration
+	HealthTimeout   time.Duration
+}
+
+// Forward leitet Verbindungen an Listen unverändert an Target weiter
+// (Portweiterleitung), auf Wunsch per CONNECT über einen Upstream-Proxy
+type Forward struct {
+	Name            string
+	Enabled         bool
+	Protocol        string        // tcp oder udp
+	Listen          string        // Adresse, z.B. :1883
+	Target          string        // host:port
+	Via             string        // Upstream-Proxy http[s]://[user:pass@]host:port, leer = direkt (nur TCP)
+	AllowedNetworks []string      // leer = allowed_networks aus [security]
+	IdleTimeout     time.Duration // UDP: Sitzung eines Clients ohne Pakete schließen
+}
+
+// HeaderRewrite fasst die Header-Aktionen für Anfrage oder Antwort zusammen
+type HeaderRewrite struct {
+	Remove  []string
+	Replace map[string]string // Header -> "<regulärer Ausdruck> => <Ersetzung>"
+	Set     map[string]string
+	Add     map[string]string
+}
+
+// MockRule beschreibt eine vorgefertigte Antwort für passende Anfragen
+type MockRule struct {
+	Name            string
+	Enabled         bool
+	Hosts           []string          // Host-Muster, leer = alle
+	Methods         []string          // leer = alle
+	Path            string            // exakter Pfad
+	PathPrefix      string            // Pfad-Präfix
+	MatchHeaders    map[string]string // Header -> regulärer Ausdruck
+	Status          int
+	ResponseHeaders map[string]string
+	Body            string // Inline-Body
+	BodyFile        string // Body aus Datei (hat Vorrang vor Body)
+	Template        bool   // Body als text/template auswerten
+}
+
+// ChaosRule beschreibt eine Fehler-/Latenz-Injektion für passende Anfragen
+type ChaosRule struct {
+	Name        string
+	Enabled     bool
+	Clients     []string // IPs oder CIDR-Netze, leer = alle
+	Hosts       []string // Host-Muster, leer = alle
+	PathPrefix  string
+	Probability float64       // 0..1
+	Latency     time.Duration // zusätzliche Verzögerung
+	Jitter      time.Duration // zufälliger Anteil zusätzlich zur Latenz
+	Throttle    int           // Bytes pro Sekunde, 0 = unbegrenzt
+	DropAfter   int64         // Verbindung nach n Bytes der Antwort abbrechen
+	Status      int           // synthetischer Statuscode statt Upstream-Antwort
+	ResetTunnel bool          // CONNECT-Tunnel per TCP-Reset beenden
+}
+
 var Cfg Config
 
 // LoadConfig lädt die Konfiguration aus der config.ini Datei
@@ -70,8 +331,32 @@ func LoadConfig() error {
 		return loadErr
 	}
 
-	// Server-Sektion
-	Cfg.Server.Port = cfg.Section("server").Key("port").MustInt(3128)
+	// Listener in [listener.<name>], ohne eigene Sektionen einer aus [server]
+	Cfg.Listeners = nil
+	for _, sec := range cfg.Section("listener").ChildSections() {
+		Cfg.Listeners = append(Cfg.Listeners, Listener{
+			Name:              strings.TrimPrefix(sec.Name(), "listener."),
+			Enabled:           sectionEnabled(sec),
+			Bind:              sec.Key("bind").String(),
+			Port:              sec.Key("port").MustInt(0),
+			Protocol:          sec.Key("protocol").In("http", []string{"http", "https", "transparent"}),
+			TProxy:            sec.Key("tproxy").MustBool(false),
+			Auth:              sec.Key("auth").In("global", []string{"global", "basic", "cert", "none"}),
+			AllowedNetworks:   splitList(sec.Key("allowed_networks").String()),
+			Routes:            splitList(sec.Key("routes").String()),
+			TLSCert:           resolvePath(basePath, sec.Key("tls_cert").String()),
+			TLSKey:            resolvePath(basePath, sec.Key("tls_key").String()),
+			ClientCA:          resolvePath(basePath, sec.Key("client_ca").String()),
+			CertUsers:         prefixedKeys(sec, "cert_user."),
+			Agent:             sec.Key("agent").String(),
+			ProxyProtocol:     sec.Key("proxy_protocol").MustBool(false),
+			ProxyProtocolFrom: splitList(sec.Key("proxy_protocol_from").String()),
+		})
+	}
+	if len(Cfg.Listeners) == 0 {
+		srvSec := cfg.Section("server")
+		Cfg.Listeners = []Listener{DefaultListener(srvSec.Key("bind").String(), srvSec.Key("port").MustInt(3128))}
+	}
 
 	// Paths-Sektion mit absoluten Pfaden
 	Cfg.Paths.StaticDir = filepath.Join(basePath, cfg.Section("paths").Key("static_dir").MustString("static"))
@@ -81,6 +366,11 @@ func LoadConfig() error {
 	// Features-Sektion
 	Cfg.Features.StatsHost = cfg.Section("features").Key("stats_host").MustString("stats.local")
 
+	// PAC-Sektion (Proxy-Autokonfiguration unter /proxy.pac und /wpad.dat)
+	pacSec := cfg.Section("pac")
+	Cfg.PAC.DirectHosts = splitList(pacSec.Key("direct_hosts").String())
+	Cfg.PAC.DirectNetworks = splitList(pacSec.Key("direct_networks").MustString("127.0.0.0/8, 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16, 169.254.0.0/16"))
+
 	// Auth-Sektion
 	authSec := cfg.Section("auth")
 	Cfg.Auth.EnableAuth = authSec.Key("enable_auth").MustBool(false)
@@ -109,6 +399,306 @@ func LoadConfig() error {
 		// Standard: Nur localhost
 		Cfg.Security.AllowedNetworks = []string{"127.0.0.1/32"}
 	}
+	Cfg.Security.AllowedDestinations = splitList(secSec.Key("allowed_destinations").String())
+	Cfg.Security.DeniedDestinations = splitList(secSec.Key("denied_destinations").String())
+	Cfg.Security.PeekSNI = secSec.Key("peek_sni").MustBool(true)
+
+	// Interception-Sektion (TLS-Interception mit eigener CA)
+	icSec := cfg.Section("interception")
+	Cfg.Interception.Enabled = icSec.Key("enabled").MustBool(false)
+	Cfg.Interception.CACert = resolvePath(basePath, icSec.Key("ca_cert").MustString("mlcproxy-ca.pem"))
+	Cfg.Interception.CAKey = resolvePath(basePath, icSec.Key("ca_key").MustString("mlcproxy-ca.key"))
+	Cfg.Interception.LeafValidity = icSec.Key("leaf_validity").MustDuration(24 * time.Hour)
+
+	// Capture-Sektion (Mitschnitt für HAR-Export)
+	capSec := cfg.Section("capture")
+	Cfg.Capture.Enabled = capSec.Key("enabled").MustBool(false)
+	Cfg.Capture.Clients = splitList(capSec.Key("clients").String())
+	Cfg.Capture.Hosts = splitList(capSec.Key("hosts").String())
+	Cfg.Capture.MaxEntries = capSec.Key("max_entries").MustInt(1000)
+	Cfg.Capture.MaxBodySize = capSec.Key("max_body_size").MustInt(64 * 1024)
+
+	// Replay-Sektion (Aufzeichnen und Abspielen von Antworten)
+	repSec := cfg.Section("replay")
+	Cfg.Replay.Mode = repSec.Key("mode").In("off", []string{"off", "record", "replay", "hybrid"})
+	Cfg.Replay.CassetteDir = resolvePath(basePath, repSec.Key("cassette_dir").MustString("cassettes"))
+	Cfg.Replay.MatchHeaders = splitList(repSec.Key("match_headers").String())
+	Cfg.Replay.MaxBodySize = repSec.Key("max_body_size").MustInt(10 * 1024 * 1024)
+
+	// Chaos-Sektion mit Regeln in [chaos.<name>]
+	chaosSec := cfg.Section("chaos")
+	Cfg.Chaos.Enabled = chaosSec.Key("enabled").MustBool(false)
+	Cfg.Chaos.Rules = nil
+	for _, sec := range chaosSec.ChildSections() {
+		Cfg.Chaos.Rules = append(Cfg.Chaos.Rules, ChaosRule{
+			Name:        strings.TrimPrefix(sec.Name(), "chaos."),
+			Enabled:     sectionEnabled(sec),
+			Clients:     splitList(sec.Key("clients").String()),
+			Hosts:       splitList(sec.Key("hosts").String()),
+			PathPrefix:  sec.Key("path_prefix").String(),
+			Probability: sec.Key("probability").MustFloat64(1),
+			Latency:     sec.Key("latency").MustDuration(0),
+			Jitter:      sec.Key("jitter").MustDuration(0),
+			Throttle:    sec.Key("throttle").MustInt(0),
+			DropAfter:   sec.Key("drop_after").MustInt64(0),
+			Status:      sec.Key("status").MustInt(0),
+			ResetTunnel: sec.Key("reset_tunnel").MustBool(false),
+		})
+	}
+
+	// Mock-Regeln in [mock.<name>]
+	Cfg.Mock.Rules = nil
+	for _, sec := range cfg.Section("mock").ChildSections() {
+		Cfg.Mock.Rules = append(Cfg.Mock.Rules, MockRule{
+			Name:            strings.TrimPrefix(sec.Name(), "mock."),
+			Enabled:         sectionEnabled(sec),
+			Hosts:           splitList(sec.Key("hosts").String()),
+			Methods:         splitList(strings.ToUpper(sec.Key("methods").String())),
+			Path:            sec.Key("path").String(),
+			PathPrefix:      sec.Key("path_prefix").String(),
+			MatchHeaders:    prefixedKeys(sec, "match_header."),
+			Status:          sec.Key("status").MustInt(200),
+			ResponseHeaders: prefixedKeys(sec, "response_header."),
+			Body:            sec.Key("body").String(),
+			BodyFile:        resolvePath(basePath, sec.Key("body_file").String()),
+			Template:        sec.Key("template").MustBool(false),
+		})
+	}
+
+	// Filter-Sektion mit Body-Regeln in [filter.<name>]
+	filterSec := cfg.Section("filter")
+	Cfg.Filter.BlockedTypes = splitList(filterSec.Key("blocked_types").String())
+	Cfg.Filter.MaxResponseSize = filterSec.Key("max_response_size").MustInt64(0)
+	Cfg.Filter.MaxRewriteSize = filterSec.Key("max_rewrite_size").MustInt(5 * 1024 * 1024)
+	Cfg.Filter.Rules = nil
+	for _, sec := range filterSec.ChildSections() {
+		Cfg.Filter.Rules = append(Cfg.Filter.Rules, FilterRule{
+			Name:         strings.TrimPrefix(sec.Name(), "filter."),
+			Enabled:      sectionEnabled(sec),
+			Hosts:        splitList(sec.Key("hosts").String()),
+			ContentTypes: splitList(sec.Key("content_types").String()),
+			Replace:      prefixedValues(sec, "replace."),
+		})
+	}
+
+	// ICAP-Sektion (externe Virenscanner/DLP nach RFC 3507)
+	icapSec := cfg.Section("icap")
+	Cfg.ICAP.Enabled = icapSec.Key("enabled").MustBool(false)
+	Cfg.ICAP.ReqModURL = icapSec.Key("reqmod_url").String()
+	Cfg.ICAP.RespModURL = icapSec.Key("respmod_url").String()
+	Cfg.ICAP.Preview = icapSec.Key("preview").MustInt(1024)
+	Cfg.ICAP.Timeout = icapSec.Key("timeout").MustDuration(30 * time.Second)
+	Cfg.ICAP.FailPolicy = icapSec.Key("fail_policy").In("open", []string{"open", "closed"})
+	Cfg.ICAP.MaxBodySize = icapSec.Key("max_body_size").MustInt(10 * 1024 * 1024)
+	Cfg.ICAP.OversizePolicy = icapSec.Key("oversize_policy").In("skip", []string{"skip", "block"})
+	Cfg.ICAP.BypassHosts = splitList(icapSec.Key("bypass_hosts").String())
+
+	// Blocklisten in [blocklist.<name>]
+	blSec := cfg.Section("blocklist")
+	Cfg.Blocklist.ReloadInterval = blSec.Key("reload_interval").MustDuration(time.Hour)
+	Cfg.Blocklist.ExemptClients = splitList(blSec.Key("exempt_clients").String())
+	Cfg.Blocklist.Lists = nil
+	for _, sec := range blSec.ChildSections() {
+		Cfg.Blocklist.Lists = append(Cfg.Blocklist.Lists, BlocklistSource{
+			Name:          strings.TrimPrefix(sec.Name(), "blocklist."),
+			Enabled:       sectionEnabled(sec),
+			File:          resolvePath(basePath, sec.Key("file").String()),
+			ExemptClients: ownList(sec, "exempt_clients"),
+		})
+	}
+
+	// Resolver-Sektion (eigene DNS-Server und feste Host-Einträge)
+	resSec := cfg.Section("resolver")
+	Cfg.Resolver.Enabled = resSec.Key("enabled").MustBool(false)
+	Cfg.Resolver.Servers = splitList(resSec.Key("servers").String())
+	Cfg.Resolver.DomainServers = make(map[string][]string)
+	for domain, servers := range prefixedKeys(resSec, "server.") {
+		Cfg.Resolver.DomainServers[strings.ToLower(domain)] = splitList(servers)
+	}
+	Cfg.Resolver.Hosts = make(map[string][]string)
+	for host, addrs := range prefixedKeys(resSec, "host.") {
+		Cfg.Resolver.Hosts[strings.ToLower(host)] = splitList(addrs)
+	}
+	Cfg.Resolver.Timeout = resSec.Key("timeout").MustDuration(5 * time.Second)
+	Cfg.Resolver.CacheTTL = resSec.Key("cache_ttl").MustDuration(time.Minute)
+	Cfg.Resolver.MaxTTL = resSec.Key("max_ttl").MustDuration(time.Hour)
+	Cfg.Resolver.CAFile = resolvePath(basePath, resSec.Key("ca_file").String())
+
+	// DNS-Sektion (DNS-Server für Clients)
+	dnsSec := cfg.Section("dns")
+	Cfg.DNS.Enabled = dnsSec.Key("enabled").MustBool(false)
+	Cfg.DNS.Listen = dnsSec.Key("listen").MustString(":53")
+	Cfg.DNS.BlockedAnswer = dnsSec.Key("blocked_answer").In("zero", []string{"zero", "nxdomain"})
+
+	rvSec := cfg.Section("rendezvous")
+	Cfg.Rendezvous.Enabled = rvSec.Key("enabled").MustBool(false)
+	Cfg.Rendezvous.Listen = rvSec.Key("listen").MustString(":3140")
+	Cfg.Rendezvous.TLSCert = resolvePath(basePath, rvSec.Key("tls_cert").String())
+	Cfg.Rendezvous.TLSKey = resolvePath(basePath, rvSec.Key("tls_key").String())
+	Cfg.Rendezvous.Tokens = prefixedKeys(rvSec, "token.")
+
+	agentSec := cfg.Section("agent")
+	Cfg.Agent.Enabled = agentSec.Key("enabled").MustBool(false)
+	Cfg.Agent.Server = agentSec.Key("server").String()
+	Cfg.Agent.Name = agentSec.Key("name").String()
+	Cfg.Agent.Token = agentSec.Key("token").String()
+	Cfg.Agent.TLS = agentSec.Key("tls").MustBool(false)
+	Cfg.Agent.CAFile = resolvePath(basePath, agentSec.Key("ca_file").String())
+	// Mindestens 1s, sonst würde der Agent den Rendezvous-Proxy ohne Pause
+	// mit Verbindungsversuchen überziehen
+	Cfg.Agent.MaxReconnectDelay = max(agentSec.Key("max_reconnect_delay").MustDuration(time.Minute), time.Second)
+
+	// Outbound-Sektion mit Routen in [outbound.<name>]
+	outSec := cfg.Section("outbound")
+	Cfg.Outbound.SourceIP = outSec.Key("source_ip").String()
+	Cfg.Outbound.Interface = outSec.Key("interface").String()
+	Cfg.Outbound.IPPreference = outSec.Key("ip_preference").In("prefer-v6", []string{"prefer-v6", "prefer-v4", "ipv4-only", "ipv6-only"})
+	Cfg.Outbound.AttemptDelay = outSec.Key("attempt_delay").MustDuration(250 * time.Millisecond)
+	Cfg.Outbound.AttemptTimeout = outSec.Key("attempt_timeout").MustDuration(5 * time.Second)
+	Cfg.Outbound.ConnectTimeout = outSec.Key("connect_timeout").MustDuration(10 * time.Second)
+	Cfg.Outbound.ProxyProtocolHosts = splitList(outSec.Key("proxy_protocol_hosts").String())
+	Cfg.Outbound.ProxyProtocolVersion = outSec.Key("proxy_protocol_version").MustInt(2)
+	Cfg.Outbound.Routes = nil
+	for _, sec := range outSec.ChildSections() {
+		Cfg.Outbound.Routes = append(Cfg.Outbound.Routes, OutboundRoute{
+			Name:      strings.TrimPrefix(sec.Name(), "outbound."),
+			Enabled:   sectionEnabled(sec),
+			Hosts:     splitList(sec.Key("hosts").String()),
+			Users:     splitList(sec.Key("users").String()),
+			SourceIP:  ownValue(sec, "source_ip"),
+			Interface: ownValue(sec, "interface"),
+		})
+	}
+
+	// Reverse-Proxy-Sites in [reverse.<name>]
+	Cfg.Reverse.Sites = nil
+	for _, sec := range cfg.Section("reverse").ChildSections() {
+		Cfg.Reverse.Sites = append(Cfg.Reverse.Sites, ReverseSite{
+			Name:            strings.TrimPrefix(sec.Name(), "reverse."),
+			Enabled:         sectionEnabled(sec),
+			Hosts:           splitList(sec.Key("hosts").String()),
+			PathPrefix:      sec.Key("path_prefix").MustString("/"),
+			Backends:        splitList(sec.Key("backends").String()),
+			PreserveHost:    sec.Key("preserve_host").MustBool(false),
+			AllowedNetworks: splitList(sec.Key("allowed_networks").String()),
+			Request:         headerRewrite(sec, "request_"),
+			Response:        headerRewrite(sec, "response_"),
+			HealthCheck:     sec.Key("health_check").String(),
+			HealthInterval:  sec.Key("health_interval").MustDuration(10 * time.Second),
+			HealthTimeout:   sec.Key("health_timeout").MustDuration(5 * time.Second),
+		})
+	}
+
+	// Portweiterleitungen in [forward.<name>]
+	Cfg.Forwards = nil
+	for _, sec := range cfg.Section("forward").ChildSections() {
+		Cfg.Forwards = append(Cfg.Forwards, Forward{
+			Name:            strings.TrimPrefix(sec.Name(), "forward."),
+			Enabled:         sectionEnabled(sec),
+			Protocol:        sec.Key("protocol").In("tcp", []string{"tcp", "udp"}),
+			Listen:          sec.Key("listen").String(),
+			Target:          sec.Key("target").String(),
+			Via:             sec.Key("via").String(),
+			AllowedNetworks: splitList(sec.Key("allowed_networks").String()),
+			IdleTimeout:     sec.Key("idle_timeout").MustDuration(60 * time.Second),
+		})
+	}
+
+	// Rewrite-Regeln in [rewrite.<name>]
+	Cfg.Rewrite.Rules = nil
+	for _, sec := range cfg.Section("rewrite").ChildSections() {
+		Cfg.Rewrite.Rules = append(Cfg.Rewrite.Rules, RewriteRule{
+			Name:         strings.TrimPrefix(sec.Name(), "rewrite."),
+			Enabled:      sectionEnabled(sec),
+			Hosts:        splitList(sec.Key("hosts").String()),
+			PathPrefix:   sec.Key("path_prefix").String(),
+			Request:      headerRewrite(sec, "request_"),
+			Response:     headerRewrite(sec, "response_"),
+			URLRewrite:   sec.Key("url_rewrite").String(),
+			RedirectHost: sec.Key("redirect_host").String(),
+			PreserveHost: sec.Key("preserve_host").MustBool(false),
+		})
+	}
 
 	return nil
 }
+
+// resolvePath macht relative Pfade relativ zum Executable-Verzeichnis
+func resolvePath(basePath, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(basePath, p)
+}
+
+// splitList zerlegt eine komma-separierte Liste und entfernt leere Einträge
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// sectionEnabled liest "enabled" einer Unter-Sektion wie [chaos.name]. Der
+// Wert der Eltern-Sektion wird dabei bewusst nicht geerbt (Standard: aktiv).
+func sectionEnabled(sec *ini.Section) bool {
+	for _, name := range sec.KeyStrings() {
+		if name == "enabled" {
+			return sec.Key(name).MustBool(true)
+		}
+	}
+	return true
+}
+
+// ownValue liest einen Wert nur aus der Sektion selbst, ohne den Wert der
+// Eltern-Sektion zu erben
+func ownValue(sec *ini.Section, name string) string {
+	for _, key := range sec.KeyStrings() {
+		if key == name {
+			return sec.Key(key).String()
+		}
+	}
+	return ""
+}
+
+// ownList liest eine Liste nur aus der Sektion selbst (siehe ownValue)
+func ownList(sec *ini.Section, name string) []string {
+	return splitList(ownValue(sec, name))
+}
+
+// prefixedKeys sammelt alle Schlüssel einer Sektion mit dem Präfix prefix,
+// z.B. "response_header.Content-Type = text/plain" -> {"Content-Type": "text/plain"}
+func prefixedKeys(sec *ini.Section, prefix string) map[string]string {
+	values := make(map[string]string)
+	for _, name := range sec.KeyStrings() {
+		if strings.HasPrefix(name, prefix) {
+			values[strings.TrimPrefix(name, prefix)] = sec.Key(name).String()
+		}
+	}
+	return values
+}
+
+// headerRewrite liest die Header-Aktionen mit dem Präfix "request_" oder "response_"
+func headerRewrite(sec *ini.Section, prefix string) HeaderRewrite {
+	return HeaderRewrite{
+		Remove:  splitList(sec.Key(prefix + "remove").String()),
+		Replace: prefixedKeys(sec, prefix+"replace."),
+		Set:     prefixedKeys(sec, prefix+"set."),
+		Add:     prefixedKeys(sec, prefix+"add."),
+	}
+}
+
+// prefixedValues liefert die Werte aller Schlüssel mit dem Präfix prefix in
+// der Reihenfolge der Datei, z.B. "replace.1 = ...", "replace.2 = ..."
+func prefixedValues(sec *ini.Section, prefix string) []string {
+	var values []string
+	for _, name := range sec.KeyStrings() {
+		if strings.HasPrefix(name, prefix) {
+			values = append(values, sec.Key(name).String())
+		}
+	}
+	return values
+}
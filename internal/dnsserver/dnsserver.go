@@ -0,0 +1,286 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+// Package dnsserver is a small DNS forwarder for clients of the proxy. It
+// answers static host entries itself, applies the domain blocklists and
+// forwards everything else to the upstream servers of the resolver.
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"mlc_goproxy/internal/blocklist"
+	"mlc_goproxy/internal/resolver"
+	"mlc_goproxy/internal/stats"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Answers for blocked names
+const (
+	BlockZero     = "zero"     // 0.0.0.0 or ::
+	BlockNXDomain = "nxdomain" // name does not exist
+)
+
+// staticTTL is the TTL of answers for static hosts and blocked names
+const staticTTL = 60
+
+// queryTimeout limits the upstream resolution of one query
+const queryTimeout = 10 * time.Second
+
+// udpWorkers limits the UDP queries answered at the same time. Further
+// datagrams wait in the socket buffer and are dropped by the kernel when
+// it is full.
+const udpWorkers = 128
+
+// Server answers DNS queries over UDP and TCP
+type Server struct {
+	Resolver      *resolver.Resolver
+	Blocklists    *blocklist.Manager   // may be nil
+	BlockedAnswer string               // BlockZero or BlockNXDomain
+	Allow         func(ip string) bool // client check, nil allows all
+}
+
+// Start binds UDP and TCP on addr and serves queries in the background
+func (s *Server) Start(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	go func() {
+		log.Printf("DNS server (UDP) stopped: %v", s.serveUDP(pc))
+	}()
+	go func() {
+		log.Printf("DNS server (TCP) stopped: %v", s.serveTCP(ln))
+	}()
+	return nil
+}
+
+func (s *Server) serveUDP(pc net.PacketConn) error {
+	workers := make(chan struct{}, udpWorkers)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		workers <- struct{}{}
+		go func() {
+			defer func() { <-workers }()
+			ip := clientIP(addr)
+			// Unlike TCP, the source of a datagram may be spoofed, so
+			// refused clients get no answer
+			if s.Allow != nil && !s.Allow(ip) {
+				return
+			}
+			answer := s.handle(ip, query)
+			if answer == nil {
+				return
+			}
+			pc.WriteTo(truncate(query, answer), addr)
+		}()
+	}
+}
+
+func (s *Server) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers length-prefixed queries until the client closes the connection
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	ip := clientIP(conn.RemoteAddr())
+	for {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		answer := s.handle(ip, query)
+		if answer == nil {
+			return
+		}
+		msg := make([]byte, 2+len(answer))
+		binary.BigEndian.PutUint16(msg, uint16(len(answer)))
+		copy(msg[2:], answer)
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one query, refused clients get REFUSED and malformed
+// queries FORMERR. It returns nil for messages that must not be answered:
+// responses and messages too short to carry an ID.
+func (s *Server) handle(ip string, query []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		if len(query) < 2 {
+			return nil
+		}
+		// Answer with the ID of the query, it is all we can parse
+		header = dnsmessage.Header{ID: binary.BigEndian.Uint16(query)}
+		return reply(header, nil, dnsmessage.RCodeFormatError, nil)
+	}
+	if header.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return reply(header, nil, dnsmessage.RCodeFormatError, nil)
+	}
+	if s.Allow != nil && !s.Allow(ip) {
+		return reply(header, &q, dnsmessage.RCodeRefused, nil)
+	}
+	name := q.Name.String()
+
+	if list := s.Blocklists.Match(ip, name); list != "" {
+		stats.LogDNSQuery(ip, true)
+		stats.LogBlocked(list)
+		log.Printf("DNS query for %s from %s blocked by list %s", name, ip, list)
+		if s.BlockedAnswer == BlockNXDomain {
+			return reply(header, &q, dnsmessage.RCodeNameError, nil)
+		}
+		return reply(header, &q, dnsmessage.RCodeSuccess, []net.IP{net.IPv4zero, net.IPv6zero})
+	}
+	stats.LogDNSQuery(ip, false)
+
+	if ips, ok := s.Resolver.StaticHost(name); ok {
+		return reply(header, &q, dnsmessage.RCodeSuccess, ips)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	answer, err := s.Resolver.Exchange(ctx, name, query)
+	if errors.Is(err, resolver.ErrNoUpstream) {
+		// Only address queries can be answered via the system resolver
+		if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+			return reply(header, &q, dnsmessage.RCodeNotImplemented, nil)
+		}
+		ips, err := s.Resolver.LookupIP(ctx, name)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return reply(header, &q, dnsmessage.RCodeNameError, nil)
+		}
+		if err != nil {
+			log.Printf("DNS lookup for %s failed: %v", name, err)
+			return reply(header, &q, dnsmessage.RCodeServerFailure, nil)
+		}
+		return reply(header, &q, dnsmessage.RCodeSuccess, ips)
+	}
+	if err != nil {
+		log.Printf("DNS query for %s failed: %v", name, err)
+		return reply(header, &q, dnsmessage.RCodeServerFailure, nil)
+	}
+	return answer
+}
+
+// reply builds an answer with the addresses of ips that match the question type
+func reply(query dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	b.StartQuestions()
+	if q == nil {
+		msg, _ := b.Finish()
+		return msg
+	}
+	b.Question(*q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: staticTTL}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)})
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+		}
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+// truncate limits a UDP answer to the size the client accepts. Larger
+// answers are replaced by an empty one with the TC bit set, so the client
+// retries over TCP.
+func truncate(query, answer []byte) []byte {
+	limit := 512
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return answer
+	}
+	if err := p.SkipAllQuestions(); err == nil {
+		p.SkipAllAnswers()
+		p.SkipAllAuthorities()
+		for {
+			rh, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type == dnsmessage.TypeOPT {
+				limit = max(limit, int(rh.Class))
+			}
+			p.SkipAdditional()
+		}
+	}
+	if len(answer) <= limit {
+		return answer
+	}
+
+	var ap dnsmessage.Parser
+	answerHeader, err := ap.Start(answer)
+	if err != nil {
+		return answer
+	}
+	q, err := ap.Question()
+	if err != nil {
+		return answer
+	}
+	answerHeader.ID = header.ID
+	answerHeader.Truncated = true
+	b := dnsmessage.NewBuilder(nil, answerHeader)
+	b.StartQuestions()
+	b.Question(q)
+	msg, _ := b.Finish()
+	return msg
+}
+
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
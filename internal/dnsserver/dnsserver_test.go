@@ -0,0 +1,207 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package dnsserver
+
+import (
+	"encoding/binary"
+	"io"
+	"mlc_goproxy/internal/blocklist"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/resolver"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// buildQuery returns a query for name; udpSize != 0 adds an EDNS0 OPT record
+// advertising that payload size
+func buildQuery(t *testing.T, id uint16, name string, typ dnsmessage.Type, udpSize uint16) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET})
+	if udpSize != 0 {
+		b.StartAdditionals()
+		b.OPTResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Class: dnsmessage.Class(udpSize)}, dnsmessage.OPTResource{})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// buildAnswer returns a response with n A records for name
+func buildAnswer(t *testing.T, id uint16, name string, n int) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true})
+	b.StartQuestions()
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	b.Question(q)
+	b.StartAnswers()
+	for i := range n {
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func parseMessage(t *testing.T, msg []byte) dnsmessage.Message {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		t.Fatalf("unpacking %x: %v", msg, err)
+	}
+	return m
+}
+
+func TestTruncate(t *testing.T) {
+	small := buildAnswer(t, 7, "a.example.", 2)
+	large := buildAnswer(t, 7, "a.example.", 40) // 40 * 16 bytes of records
+	tests := []struct {
+		name          string
+		query         []byte
+		answer        []byte
+		wantTruncated bool
+	}{
+		{name: "fits into 512 bytes", query: buildQuery(t, 7, "a.example.", dnsmessage.TypeA, 0), answer: small},
+		{name: "larger than 512 bytes", query: buildQuery(t, 7, "a.example.", dnsmessage.TypeA, 0), answer: large, wantTruncated: true},
+		{name: "EDNS0 allows more", query: buildQuery(t, 7, "a.example.", dnsmessage.TypeA, 1232), answer: large},
+		{name: "EDNS0 below 512", query: buildQuery(t, 7, "a.example.", dnsmessage.TypeA, 256), answer: large, wantTruncated: true},
+		{name: "query not parseable", query: []byte{1, 2, 3}, answer: large},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := truncate(tc.query, tc.answer)
+			m := parseMessage(t, got)
+			if m.Truncated != tc.wantTruncated {
+				t.Fatalf("truncated = %v, want %v", m.Truncated, tc.wantTruncated)
+			}
+			if !tc.wantTruncated {
+				if len(got) != len(tc.answer) {
+					t.Errorf("answer changed from %d to %d bytes", len(tc.answer), len(got))
+				}
+				return
+			}
+			if len(got) > 512 || len(m.Answers) != 0 {
+				t.Errorf("truncated answer has %d bytes and %d records", len(got), len(m.Answers))
+			}
+			if m.Header.ID != 7 || len(m.Questions) != 1 {
+				t.Errorf("truncated answer has ID %d and %d questions, want the query's", m.Header.ID, len(m.Questions))
+			}
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	dir := t.TempDir()
+	listFile := filepath.Join(dir, "ads.txt")
+	if err := os.WriteFile(listFile, []byte("ads.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lists, err := blocklist.New([]config.BlocklistSource{{Name: "ads", Enabled: true, File: listFile}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := resolver.New(resolver.Options{Hosts: map[string][]string{"nas.lan": {"192.168.1.5"}}, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Resolver:   res,
+		Blocklists: lists,
+		Allow:      func(ip string) bool { return ip != "198.51.100.1" },
+	}
+
+	response := buildAnswer(t, 1, "nas.lan.", 1)
+	tests := []struct {
+		name      string
+		ip        string
+		query     []byte
+		blocked   string
+		wantNil   bool
+		wantRCode dnsmessage.RCode
+		wantIP    string
+	}{
+		{name: "static host", ip: "192.0.2.10", query: buildQuery(t, 1, "nas.lan.", dnsmessage.TypeA, 0), wantIP: "192.168.1.5"},
+		{name: "client not allowed", ip: "198.51.100.1", query: buildQuery(t, 1, "nas.lan.", dnsmessage.TypeA, 0), wantRCode: dnsmessage.RCodeRefused},
+		{name: "blocked zero", ip: "192.0.2.10", query: buildQuery(t, 1, "www.ads.example.", dnsmessage.TypeA, 0), wantIP: "0.0.0.0"},
+		{name: "blocked nxdomain", ip: "192.0.2.10", query: buildQuery(t, 1, "ads.example.", dnsmessage.TypeA, 0), blocked: BlockNXDomain, wantRCode: dnsmessage.RCodeNameError},
+		{name: "no question", ip: "192.0.2.10", query: []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}, wantRCode: dnsmessage.RCodeFormatError},
+		{name: "header truncated", ip: "192.0.2.10", query: []byte{0, 1, 1, 0}, wantRCode: dnsmessage.RCodeFormatError},
+		{name: "no ID", ip: "192.0.2.10", query: []byte{0}, wantNil: true},
+		{name: "response", ip: "192.0.2.10", query: response, wantNil: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.BlockedAnswer = tc.blocked
+			answer := s.handle(tc.ip, tc.query)
+			if tc.wantNil {
+				if answer != nil {
+					t.Errorf("got an answer %x, want none", answer)
+				}
+				return
+			}
+			if answer == nil {
+				t.Fatal("got no answer")
+			}
+			m := parseMessage(t, answer)
+			if !m.Header.Response || m.Header.ID != 1 {
+				t.Errorf("answer has response bit %v and ID %d, want a response with ID 1", m.Header.Response, m.Header.ID)
+			}
+			if m.Header.RCode != tc.wantRCode {
+				t.Errorf("rcode = %v, want %v", m.Header.RCode, tc.wantRCode)
+			}
+			if tc.wantIP == "" {
+				return
+			}
+			if len(m.Answers) != 1 {
+				t.Fatalf("got %d records, want 1", len(m.Answers))
+			}
+			a, ok := m.Answers[0].Body.(*dnsmessage.AResource)
+			if !ok || net.IP(a.A[:]).String() != tc.wantIP {
+				t.Errorf("answer = %v, want %s", m.Answers[0].Body, tc.wantIP)
+			}
+		})
+	}
+}
+
+func TestTCPRefused(t *testing.T) {
+	s := &Server{Allow: func(string) bool { return false }}
+	local, peer := net.Pipe()
+	go s.serveConn(local)
+	defer peer.Close()
+
+	// A refused client gets an answer on TCP instead of a closed connection
+	query := buildQuery(t, 42, "www.example.", dnsmessage.TypeA, 0)
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(peer, length[:]); err != nil {
+		t.Fatalf("reading answer: %v", err)
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(peer, answer); err != nil {
+		t.Fatal(err)
+	}
+	if m := parseMessage(t, answer); m.Header.ID != 42 || m.Header.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("got ID %d rcode %v, want ID 42 REFUSED", m.Header.ID, m.Header.RCode)
+	}
+}
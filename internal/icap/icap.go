@@ -0,0 +1,248 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+// Package icap implements a minimal RFC 3507 client for the REQMOD and
+// RESPMOD methods, e.g. to hand traffic to c-icap with ClamAV.
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPort is used if the service URL has no port
+const DefaultPort = "1344"
+
+// Client talks to ICAP services. Every transaction uses its own connection.
+type Client struct {
+	Timeout time.Duration // dial and transaction timeout
+	Preview int           // preview size in bytes, negative disables previews
+}
+
+// Message is an encapsulated HTTP header section
+type Message struct {
+	StartLine string // request line or status line
+	Header    http.Header
+}
+
+// StatusCode returns the status code of an encapsulated response, 0 if the
+// start line cannot be parsed
+func (m *Message) StatusCode() int {
+	_, rest, _ := strings.Cut(m.StartLine, " ")
+	code, _ := strconv.Atoi(strings.SplitN(rest, " ", 2)[0])
+	return code
+}
+
+// Response is the answer of an ICAP service
+type Response struct {
+	StatusCode int
+	Status     string
+	Header     http.Header // ICAP headers such as X-Infection-Found
+	Request    *Message    // modified request (REQMOD), nil if absent
+	Response   *Message    // modified or replacement HTTP response, nil if absent
+	Body       []byte      // encapsulated body, nil for null-body
+}
+
+// Unmodified reports whether the service answered 204 No Content
+func (r *Response) Unmodified() bool {
+	return r.StatusCode == http.StatusNoContent
+}
+
+// ReqMod sends req to a REQMOD service. body is nil if the request has none.
+func (c *Client) ReqMod(service string, req *http.Request, body []byte) (*Response, error) {
+	return c.do("REQMOD", service, [][]byte{requestHeader(req)}, body)
+}
+
+// RespMod sends resp (and the request it answers) to a RESPMOD service.
+// body is nil if the response has none.
+func (c *Client) RespMod(service string, req *http.Request, resp *http.Response, body []byte) (*Response, error) {
+	return c.do("RESPMOD", service, [][]byte{requestHeader(req), responseHeader(resp)}, body)
+}
+
+func (c *Client) do(method, service string, sections [][]byte, body []byte) (*Response, error) {
+	u, err := url.Parse(service)
+	if err != nil || u.Scheme != "icap" || u.Host == "" {
+		return nil, fmt.Errorf("icap: invalid service URL %q", service)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("icap: %w", err)
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	// Encapsulated lists the offsets of the header sections and the body
+	names := []string{"req-hdr", "res-hdr"}
+	bodyName := "req-body"
+	if method == "RESPMOD" {
+		bodyName = "res-body"
+	}
+	if body == nil {
+		bodyName = "null-body"
+	}
+	var encapsulated []string
+	var payload bytes.Buffer
+	for i, section := range sections {
+		encapsulated = append(encapsulated, fmt.Sprintf("%s=%d", names[i], payload.Len()))
+		payload.Write(section)
+	}
+	encapsulated = append(encapsulated, fmt.Sprintf("%s=%d", bodyName, payload.Len()))
+
+	preview := -1
+	if body != nil && c.Preview >= 0 {
+		preview = min(c.Preview, len(body))
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s ICAP/1.0\r\n", method, service)
+	fmt.Fprintf(w, "Host: %s\r\n", u.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	if preview >= 0 {
+		fmt.Fprintf(w, "Preview: %d\r\n", preview)
+	}
+	fmt.Fprintf(w, "Encapsulated: %s\r\n", strings.Join(encapsulated, ", "))
+	fmt.Fprintf(w, "Connection: close\r\n\r\n")
+	w.Write(payload.Bytes())
+
+	r := bufio.NewReader(conn)
+	switch {
+	case body == nil:
+	case preview < 0:
+		writeChunk(w, body)
+		fmt.Fprintf(w, "0\r\n\r\n")
+	default:
+		writeChunk(w, body[:preview])
+		if preview == len(body) {
+			// The service knows the whole body and must not ask for more
+			fmt.Fprintf(w, "0; ieof\r\n\r\n")
+			break
+		}
+		fmt.Fprintf(w, "0\r\n\r\n")
+		if err := w.Flush(); err != nil {
+			return nil, fmt.Errorf("icap: %w", err)
+		}
+		resp, err := readResponse(r)
+		if err != nil || resp.StatusCode != http.StatusContinue {
+			// The service decided after the preview (usually 204)
+			return resp, err
+		}
+		writeChunk(w, body[preview:])
+		fmt.Fprintf(w, "0\r\n\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("icap: %w", err)
+	}
+	return readResponse(r)
+}
+
+// readResponse reads one ICAP response including the encapsulated sections
+func readResponse(r *bufio.Reader) (*Response, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("icap: reading status: %w", err)
+	}
+	proto, status, _ := strings.Cut(line, " ")
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if !strings.HasPrefix(proto, "ICAP/") || err != nil {
+		return nil, fmt.Errorf("icap: malformed status line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("icap: reading headers: %w", err)
+	}
+	resp := &Response{StatusCode: code, Status: status, Header: http.Header(header)}
+
+	switch code {
+	case http.StatusContinue, http.StatusNoContent:
+		return resp, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("icap: service returned %s", status)
+	}
+
+	for _, part := range strings.Split(resp.Header.Get("Encapsulated"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "req-hdr", "res-hdr":
+			msg, err := readMessage(tp)
+			if err != nil {
+				return nil, fmt.Errorf("icap: reading %s: %w", name, err)
+			}
+			if name == "req-hdr" {
+				resp.Request = msg
+			} else {
+				resp.Response = msg
+			}
+		case "req-body", "res-body":
+			if resp.Body, err = io.ReadAll(httputil.NewChunkedReader(r)); err != nil {
+				return nil, fmt.Errorf("icap: reading %s: %w", name, err)
+			}
+		}
+	}
+	return resp, nil
+}
+
+func readMessage(tp *textproto.Reader) (*Message, error) {
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{StartLine: line, Header: http.Header(header)}, nil
+}
+
+func writeChunk(w io.Writer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%x\r\n", len(data))
+	w.Write(data)
+	io.WriteString(w, "\r\n")
+}
+
+// requestHeader serializes the request line and headers of req
+func requestHeader(req *http.Request) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", req.Method, req.URL.String())
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&buf, "Host: %s\r\n", host)
+	req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// responseHeader serializes the status line and headers of resp
+func responseHeader(resp *http.Response) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,366 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package icap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubRequest is an ICAP request as seen by the stub server
+type stubRequest struct {
+	Method       string
+	Header       textproto.MIMEHeader
+	Encapsulated string // raw HTTP header sections
+	Body         []byte
+	IEOF         bool // the last chunk carried the ieof extension
+}
+
+// startStub runs an ICAP server on a local port that passes every
+// connection to handle and returns the service URL
+func startStub(t *testing.T, handle func(r *bufio.Reader, w io.Writer)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(bufio.NewReader(conn), conn)
+			}()
+		}
+	}()
+	return "icap://" + ln.Addr().String() + "/scan"
+}
+
+// readStubRequest reads the ICAP headers, the encapsulated HTTP headers and
+// the body chunks up to the first zero chunk (the preview, if one is sent)
+func readStubRequest(r *bufio.Reader) (*stubRequest, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	req := &stubRequest{Method: strings.Fields(line)[0], Header: header}
+
+	// The offset of the last entry is the length of the header sections
+	parts := strings.Split(header.Get("Encapsulated"), ",")
+	last := strings.TrimSpace(parts[len(parts)-1])
+	name, offset, _ := strings.Cut(last, "=")
+	n, err := strconv.Atoi(offset)
+	if err != nil {
+		return nil, fmt.Errorf("bad Encapsulated %q", header.Get("Encapsulated"))
+	}
+	sections := make([]byte, n)
+	if _, err := io.ReadFull(r, sections); err != nil {
+		return nil, err
+	}
+	req.Encapsulated = string(sections)
+	if name != "null-body" {
+		req.Body, req.IEOF, err = readChunks(r)
+	}
+	return req, err
+}
+
+// readChunks reads chunks up to and including the terminating zero chunk
+func readChunks(r *bufio.Reader) ([]byte, bool, error) {
+	tp := textproto.NewReader(r)
+	var body []byte
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		sizeField, ext, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("bad chunk size %q", line)
+		}
+		if size == 0 {
+			_, err := tp.ReadLine()
+			return body, strings.TrimSpace(ext) == "ieof", err
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, false, err
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+// chunked encodes body as a single chunk followed by the zero chunk
+func chunked(body string) string {
+	return fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+}
+
+func testRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/upload", nil)
+	req.Header.Set("Content-Type", "text/plain")
+	return req
+}
+
+func testResponse() *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/octet-stream"}},
+	}
+}
+
+func TestRespModUnmodified(t *testing.T) {
+	requests := make(chan *stubRequest, 1)
+	service := startStub(t, func(r *bufio.Reader, w io.Writer) {
+		req, err := readStubRequest(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		requests <- req
+		io.WriteString(w, "ICAP/1.0 204 No Content\r\n\r\n")
+	})
+
+	client := &Client{Timeout: 5 * time.Second, Preview: -1}
+	res, err := client.RespMod(service, testRequest(), testResponse(), []byte("file content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Unmodified() {
+		t.Errorf("status = %d, want 204", res.StatusCode)
+	}
+
+	req := <-requests
+	if req.Method != "RESPMOD" {
+		t.Errorf("method = %q, want RESPMOD", req.Method)
+	}
+	if req.Header.Get("Preview") != "" {
+		t.Errorf("unexpected Preview header %q", req.Header.Get("Preview"))
+	}
+	if req.Header.Get("Allow") != "204" {
+		t.Errorf("Allow = %q, want 204", req.Header.Get("Allow"))
+	}
+	reqHdr := "POST http://example.com/upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\n\r\n"
+	resHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+	wantEncapsulated := fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(reqHdr), len(reqHdr)+len(resHdr))
+	if got := req.Header.Get("Encapsulated"); got != wantEncapsulated {
+		t.Errorf("Encapsulated = %q, want %q", got, wantEncapsulated)
+	}
+	if req.Encapsulated != reqHdr+resHdr {
+		t.Errorf("header sections = %q, want %q", req.Encapsulated, reqHdr+resHdr)
+	}
+	if string(req.Body) != "file content" || req.IEOF {
+		t.Errorf("body = %q (ieof %v), want %q", req.Body, req.IEOF, "file content")
+	}
+}
+
+func TestRespModReplacement(t *testing.T) {
+	service := startStub(t, func(r *bufio.Reader, w io.Writer) {
+		if _, err := readStubRequest(r); err != nil {
+			t.Error(err)
+			return
+		}
+		resHdr := "HTTP/1.1 403 Forbidden\r\nContent-Type: text/html\r\n\r\n"
+		fmt.Fprintf(w, "ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=EICAR;\r\n"+
+			"Encapsulated: res-hdr=0, res-body=%d\r\n\r\n%s%s", len(resHdr), resHdr, chunked("<h1>Blocked</h1>"))
+	})
+
+	client := &Client{Timeout: 5 * time.Second, Preview: -1}
+	res, err := client.RespMod(service, testRequest(), testResponse(), []byte("X5O!P%@AP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Unmodified() || res.Response == nil {
+		t.Fatalf("got %d without response, want a replacement response", res.StatusCode)
+	}
+	if code := res.Response.StatusCode(); code != http.StatusForbidden {
+		t.Errorf("encapsulated status = %d, want 403", code)
+	}
+	if ct := res.Response.Header.Get("Content-Type"); ct != "text/html" {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+	if string(res.Body) != "<h1>Blocked</h1>" {
+		t.Errorf("body = %q", res.Body)
+	}
+	if !strings.Contains(res.Header.Get("X-Infection-Found"), "EICAR") {
+		t.Errorf("X-Infection-Found = %q", res.Header.Get("X-Infection-Found"))
+	}
+}
+
+func TestReqModModifiedRequest(t *testing.T) {
+	service := startStub(t, func(r *bufio.Reader, w io.Writer) {
+		req, err := readStubRequest(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if req.Method != "REQMOD" || !strings.Contains(req.Header.Get("Encapsulated"), "null-body=") {
+			t.Errorf("got %s with Encapsulated %q, want REQMOD with null-body", req.Method, req.Header.Get("Encapsulated"))
+		}
+		reqHdr := "GET http://example.com/clean HTTP/1.1\r\nHost: example.com\r\nX-Scanned: yes\r\n\r\n"
+		fmt.Fprintf(w, "ICAP/1.0 200 OK\r\nEncapsulated: req-hdr=0, req-body=%d\r\n\r\n%s%s", len(reqHdr), reqHdr, chunked("new"))
+	})
+
+	client := &Client{Timeout: 5 * time.Second, Preview: 0}
+	res, err := client.ReqMod(service, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Request == nil || res.Response != nil {
+		t.Fatalf("request = %v, response = %v, want only a modified request", res.Request, res.Response)
+	}
+	if res.Request.StartLine != "GET http://example.com/clean HTTP/1.1" {
+		t.Errorf("start line = %q", res.Request.StartLine)
+	}
+	if res.Request.Header.Get("X-Scanned") != "yes" || string(res.Body) != "new" {
+		t.Errorf("header = %v, body = %q", res.Request.Header, res.Body)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	body := []byte("0123456789abcdef")
+	tests := []struct {
+		name      string
+		preview   int
+		answer    string // answer to the preview
+		wantIEOF  bool
+		wantRest  string // body sent after 100 Continue, "" = none expected
+		wantCode  int
+		wantTotal bool // the preview contains the whole body
+	}{
+		{name: "continue", preview: 4, answer: "ICAP/1.0 100 Continue\r\n\r\n", wantRest: "456789abcdef", wantCode: http.StatusNoContent},
+		{name: "decided after preview", preview: 4, answer: "ICAP/1.0 204 No Content\r\n\r\n", wantCode: http.StatusNoContent},
+		{name: "whole body with ieof", preview: 64, wantIEOF: true, wantCode: http.StatusNoContent, wantTotal: true},
+		{name: "empty preview", preview: 0, answer: "ICAP/1.0 100 Continue\r\n\r\n", wantRest: string(body), wantCode: http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rest := make(chan string, 1)
+			service := startStub(t, func(r *bufio.Reader, w io.Writer) {
+				req, err := readStubRequest(r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				wantPreview := min(tc.preview, len(body))
+				if got := req.Header.Get("Preview"); got != strconv.Itoa(wantPreview) {
+					t.Errorf("Preview = %q, want %d", got, wantPreview)
+				}
+				if string(req.Body) != string(body[:wantPreview]) || req.IEOF != tc.wantIEOF {
+					t.Errorf("preview = %q (ieof %v), want %q (ieof %v)", req.Body, req.IEOF, body[:wantPreview], tc.wantIEOF)
+				}
+				if tc.wantTotal {
+					io.WriteString(w, "ICAP/1.0 204 No Content\r\n\r\n")
+					return
+				}
+				io.WriteString(w, tc.answer)
+				if !strings.Contains(tc.answer, " 100 ") {
+					return
+				}
+				data, _, err := readChunks(r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				rest <- string(data)
+				io.WriteString(w, "ICAP/1.0 204 No Content\r\n\r\n")
+			})
+
+			client := &Client{Timeout: 5 * time.Second, Preview: tc.preview}
+			res, err := client.RespMod(service, testRequest(), testResponse(), body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tc.wantCode {
+				t.Errorf("status = %d, want %d", res.StatusCode, tc.wantCode)
+			}
+			if tc.wantRest != "" {
+				if got := <-rest; got != tc.wantRest {
+					t.Errorf("rest of body = %q, want %q", got, tc.wantRest)
+				}
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedService := "icap://" + ln.Addr().String() + "/scan"
+	ln.Close()
+
+	answer := func(response string) func(*bufio.Reader, io.Writer) {
+		return func(r *bufio.Reader, w io.Writer) {
+			readStubRequest(r)
+			io.WriteString(w, response)
+		}
+	}
+	tests := []struct {
+		name    string
+		handle  func(*bufio.Reader, io.Writer) // nil: use service
+		service string
+	}{
+		{name: "invalid URL", service: "http://127.0.0.1:1344/scan"},
+		{name: "connection refused", service: closedService},
+		{name: "server error", handle: answer("ICAP/1.0 500 Server Error\r\n\r\n")},
+		{name: "malformed status", handle: answer("HTTP/1.1 200 OK\r\n\r\n")},
+		{name: "closed without answer", handle: answer("")},
+		{name: "truncated body", handle: answer("ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\nHTTP/1.1 200 OK\r\n\r\n10\r\nshort")},
+		{name: "timeout", handle: func(r *bufio.Reader, w io.Writer) {
+			readStubRequest(r)
+			time.Sleep(2 * time.Second)
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			service := tc.service
+			if tc.handle != nil {
+				service = startStub(t, tc.handle)
+			}
+			client := &Client{Timeout: 500 * time.Millisecond, Preview: -1}
+			res, err := client.RespMod(service, testRequest(), testResponse(), []byte("data"))
+			if err == nil {
+				t.Fatalf("got status %d, want an error", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestMessageStatusCode(t *testing.T) {
+	tests := map[string]int{
+		"HTTP/1.1 403 Forbidden": 403,
+		"HTTP/1.0 200":           200,
+		"garbage":                0,
+		"":                       0,
+	}
+	for line, want := range tests {
+		if got := (&Message{StartLine: line}).StatusCode(); got != want {
+			t.Errorf("StatusCode(%q) = %d, want %d", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+// Package mux multiplexes independent streams over a single connection. It
+// carries the traffic between a rendezvous proxy and its agents.
+//
+// Every frame starts with a 9 byte header: type (1 byte), stream ID and
+// payload length (4 bytes each, big endian). Each stream has its own send
+// window, so a slow stream does not block the others.
+package mux
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	frameOpen   = iota + 1 // open a stream, payload: target address
+	frameAck               // stream opened
+	frameData              // stream data
+	frameWindow            // payload: number of bytes the receiver consumed
+	frameClose             // sender will not write anymore
+	frameReset             // stream aborted, payload: optional reason
+	framePing              // keepalive, ignored by the receiver
+
+	headerSize   = 9
+	maxPayload   = 16 * 1024
+	windowSize   = 256 * 1024
+	pingInterval = 30 * time.Second
+	idleTimeout  = 3 * pingInterval // no frame from the peer within this: session is dead
+)
+
+// ErrSessionClosed is returned for operations on a closed session
+var ErrSessionClosed = errors.New("mux: session closed")
+
+// Session multiplexes streams over one connection. Both sides can open
+// streams, only the client side accepts them.
+type Session struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	wmu     sync.Mutex // serializes frame writes
+	accepts bool       // the peer may open streams
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	accept    chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Client starts a session on conn for the side that dialed the connection.
+// It opens streams with odd IDs and accepts the streams of the server.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1, true)
+}
+
+// Server starts a session on conn for the side that accepted the
+// connection. It opens streams with even IDs. Streams opened by the client
+// are reset, so Accept only returns when the session ends.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2, false)
+}
+
+func newSession(conn net.Conn, firstID uint32, accepts bool) *Session {
+	s := &Session{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		accepts: accepts,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		accept:  make(chan *Stream, 64),
+		done:    make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.pingLoop()
+	return s
+}
+
+// Open opens a stream the peer receives with the given target and waits
+// until the peer acknowledges or rejects it
+func (s *Session) Open(ctx context.Context, target string) (*Stream, error) {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id, target)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, []byte(target)); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	select {
+	case err := <-st.opened:
+		if err != nil {
+			s.remove(id)
+			return nil, err
+		}
+		return st, nil
+	case <-ctx.Done():
+		st.Close()
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Accept waits for a stream opened by the peer. The stream must be answered
+// with Ack or Reject.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Close closes the session and all of its streams
+func (s *Session) Close() error {
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+// Done is closed when the session has ended
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, nil while it is running
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// RemoteAddr returns the address of the peer
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	var header [headerSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	select {
+	case <-s.done:
+		return s.err
+	default:
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+	_, err := s.conn.Write(header[:])
+	if err == nil && len(payload) > 0 {
+		_, err = s.conn.Write(payload)
+	}
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+func (s *Session) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.writeFrame(framePing, 0, nil)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	var header [headerSize]byte
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+			s.fail(err)
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+		if length > maxPayload {
+			s.fail(fmt.Errorf("mux: frame of %d bytes exceeds the limit", length))
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.reader, payload); err != nil {
+			s.fail(err)
+			return
+		}
+
+		if typ == frameOpen {
+			if err := s.opened(id, string(payload)); err != nil {
+				s.fail(err)
+				return
+			}
+			continue
+		}
+		st := s.stream(id)
+		if st == nil {
+			// Frames for streams closed locally in the meantime
+			continue
+		}
+		switch typ {
+		case frameAck:
+			select {
+			case st.opened <- nil:
+			default:
+			}
+		case frameData:
+			st.receive(payload)
+		case frameWindow:
+			if len(payload) == 4 {
+				st.grow(binary.BigEndian.Uint32(payload))
+			}
+		case frameClose:
+			st.peerClosed(false, "")
+		case frameReset:
+			s.remove(id)
+			st.peerClosed(true, string(payload))
+		}
+	}
+}
+
+// opened handles a stream opened by the peer. Streams the session does not
+// accept and streams beyond the accept queue are reset, so the receive loop
+// never blocks on a slow or missing Accept.
+func (s *Session) opened(id uint32, target string) error {
+	if !s.accepts {
+		return s.writeFrame(frameReset, id, []byte("mux: opening streams is not allowed"))
+	}
+	// The server opens streams with even IDs
+	if id == 0 || id%2 != 0 {
+		return fmt.Errorf("mux: peer opened stream with invalid ID %d", id)
+	}
+	st := newStream(s, id, target)
+	s.mu.Lock()
+	_, exists := s.streams[id]
+	if !exists {
+		s.streams[id] = st
+	}
+	s.mu.Unlock()
+	if exists {
+		return fmt.Errorf("mux: peer opened stream %d twice", id)
+	}
+	select {
+	case s.accept <- st:
+		return nil
+	default:
+		s.remove(id)
+		return s.writeFrame(frameReset, id, []byte("mux: too many pending streams"))
+	}
+}
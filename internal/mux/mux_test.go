@@ -0,0 +1,311 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRawFrame writes a frame to conn, bypassing a session
+func writeRawFrame(t *testing.T, conn net.Conn, typ byte, id uint32, payload []byte) {
+	t.Helper()
+	frame := []byte{typ}
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("writing frame: %v", err)
+	}
+}
+
+// readRawFrame reads the next frame from conn, skipping pings
+func readRawFrame(t *testing.T, conn net.Conn) (byte, uint32, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var header [headerSize]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			t.Fatalf("reading frame header: %v", err)
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[5:9]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			t.Fatalf("reading frame payload: %v", err)
+		}
+		if header[0] != framePing {
+			return header[0], binary.BigEndian.Uint32(header[1:5]), payload
+		}
+	}
+}
+
+// pair returns a connected client and server session
+func pair(t *testing.T) (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	client, server := Client(c1), Server(c2)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func waitDone(t *testing.T, s *Session) error {
+	t.Helper()
+	select {
+	case <-s.Done():
+		return s.Err()
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+		return nil
+	}
+}
+
+func TestFrameEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     byte
+		id      uint32
+		payload []byte
+		want    []byte
+	}{
+		{name: "open", typ: frameOpen, id: 2, payload: []byte("a:1"),
+			want: []byte{frameOpen, 0, 0, 0, 2, 0, 0, 0, 3, 'a', ':', '1'}},
+		{name: "ack", typ: frameAck, id: 1,
+			want: []byte{frameAck, 0, 0, 0, 1, 0, 0, 0, 0}},
+		{name: "window", typ: frameWindow, id: 0x01020304, payload: []byte{0, 2, 0, 0},
+			want: []byte{frameWindow, 1, 2, 3, 4, 0, 0, 0, 4, 0, 2, 0, 0}},
+		{name: "close", typ: frameClose, id: 0xffffffff,
+			want: []byte{frameClose, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			local, peer := net.Pipe()
+			s := Client(local)
+			defer s.Close()
+
+			go s.writeFrame(tc.typ, tc.id, tc.payload)
+			got := make([]byte, len(tc.want))
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(peer, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("frame = % x, want % x", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	client, server := pair(t)
+
+	// More than the send window, so window updates are needed
+	upload := make([]byte, 3*windowSize+123)
+	download := make([]byte, 2*windowSize+7)
+	rand.Read(upload)
+	rand.Read(download)
+
+	accepted := make(chan error, 1)
+	go func() {
+		st, err := client.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer st.Close()
+		if st.Target() != "example.com:443" {
+			accepted <- errors.New("wrong target " + st.Target())
+			return
+		}
+		if err := st.Ack(); err != nil {
+			accepted <- err
+			return
+		}
+		got, err := io.ReadAll(st)
+		if err == nil && !bytes.Equal(got, upload) {
+			err = errors.New("upload corrupted")
+		}
+		if err == nil {
+			_, err = st.Write(download)
+		}
+		if err == nil {
+			err = st.CloseWrite()
+		}
+		accepted <- err
+	}()
+
+	st, err := server.Open(context.Background(), "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := st.Write(upload); err != nil {
+		t.Fatal(err)
+	}
+	st.CloseWrite()
+	got, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, download) {
+		t.Errorf("download corrupted: got %d bytes, want %d", len(got), len(download))
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReject(t *testing.T) {
+	client, server := pair(t)
+	go func() {
+		if st, err := client.Accept(); err == nil {
+			st.Reject(errors.New("destination not allowed"))
+		}
+	}()
+	if _, err := server.Open(context.Background(), "blocked.example:22"); err == nil || !strings.Contains(err.Error(), "destination not allowed") {
+		t.Errorf("Open error = %v, want the reject reason", err)
+	}
+}
+
+func TestOpenTimeout(t *testing.T) {
+	_, server := pair(t) // the client never answers
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := server.Open(ctx, "slow.example:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Open error = %v, want deadline exceeded", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, server := pair(t)
+	go func() {
+		if st, err := client.Accept(); err == nil {
+			st.Ack()
+		}
+	}()
+	st, err := server.Open(context.Background(), "idle.example:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	var netErr net.Error
+	if _, err := st.Read(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Read error = %v, want a timeout", err)
+	}
+}
+
+func TestServerResetsPeerOpens(t *testing.T) {
+	local, peer := net.Pipe()
+	s := Server(local)
+	defer s.Close()
+
+	writeRawFrame(t, peer, frameOpen, 1, []byte("internal.example:22"))
+	typ, id, _ := readRawFrame(t, peer)
+	if typ != frameReset || id != 1 {
+		t.Errorf("got frame type %d for stream %d, want a reset of stream 1", typ, id)
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("session ended: %v", err)
+	}
+}
+
+func TestClientAcceptQueueFull(t *testing.T) {
+	local, peer := net.Pipe()
+	s := Client(local)
+	defer s.Close()
+
+	// Nobody calls Accept: the queue fills up, further streams are reset
+	// while the session keeps running
+	queue := cap(s.accept)
+	for i := range queue {
+		writeRawFrame(t, peer, frameOpen, uint32(2*(i+1)), []byte("a:1"))
+	}
+	overflow := uint32(2 * (queue + 1))
+	writeRawFrame(t, peer, frameOpen, overflow, []byte("a:1"))
+	typ, id, _ := readRawFrame(t, peer)
+	if typ != frameReset || id != overflow {
+		t.Errorf("got frame type %d for stream %d, want a reset of stream %d", typ, id, overflow)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("session ended: %v", err)
+	}
+	st, err := s.Accept()
+	if err != nil || st.id != 2 {
+		t.Errorf("Accept = %v, %v, want the first queued stream", st, err)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames func(t *testing.T, peer net.Conn)
+	}{
+		{name: "frame too large", frames: func(t *testing.T, peer net.Conn) {
+			header := []byte{frameData, 0, 0, 0, 1}
+			header = binary.BigEndian.AppendUint32(header, maxPayload+1)
+			peer.Write(header)
+		}},
+		{name: "odd stream ID from server", frames: func(t *testing.T, peer net.Conn) {
+			writeRawFrame(t, peer, frameOpen, 3, []byte("a:1"))
+		}},
+		{name: "stream ID 0", frames: func(t *testing.T, peer net.Conn) {
+			writeRawFrame(t, peer, frameOpen, 0, []byte("a:1"))
+		}},
+		{name: "stream opened twice", frames: func(t *testing.T, peer net.Conn) {
+			writeRawFrame(t, peer, frameOpen, 2, []byte("a:1"))
+			writeRawFrame(t, peer, frameOpen, 2, []byte("a:1"))
+		}},
+		{name: "truncated payload", frames: func(t *testing.T, peer net.Conn) {
+			header := []byte{frameData, 0, 0, 0, 1, 0, 0, 0, 10, 'x'}
+			peer.Write(header)
+			peer.Close()
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			local, peer := net.Pipe()
+			s := Client(local)
+			defer s.Close()
+			go tc.frames(t, peer)
+			if err := waitDone(t, s); err == nil {
+				t.Error("session ended without error")
+			}
+		})
+	}
+}
+
+func TestCloseEndsStreams(t *testing.T) {
+	client, server := pair(t)
+	go func() {
+		if st, err := client.Accept(); err == nil {
+			st.Ack()
+		}
+	}()
+	st, err := server.Open(context.Background(), "a.example:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := waitDone(t, server); err == nil {
+		t.Error("server session ended without error")
+	}
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Error("Read on a stream of a closed session succeeded")
+	}
+	if _, err := server.Open(context.Background(), "b.example:80"); err == nil {
+		t.Error("Open on a closed session succeeded")
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is one connection inside a session. It implements net.Conn and
+// supports half-closing with CloseWrite.
+type Stream struct {
+	id      uint32
+	session *Session
+	target  string
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	consumed      uint32 // read by the application, not yet reported to the peer
+	sendWindow    uint32
+	readClosed    bool // the peer closed or reset the stream
+	writeClosed   bool
+	reset         bool
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable chan struct{} // signals new data or state changes
+	writable chan struct{} // signals a grown send window or state changes
+	opened   chan error    // result of Open
+}
+
+func newStream(s *Session, id uint32, target string) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		target:     target,
+		sendWindow: windowSize,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		opened:     make(chan error, 1),
+	}
+}
+
+// Target returns the address passed to Open by the peer
+func (st *Stream) Target() string {
+	return st.target
+}
+
+// Ack confirms a stream received with Accept
+func (st *Stream) Ack() error {
+	return st.session.writeFrame(frameAck, st.id, nil)
+}
+
+// Reject refuses a stream received with Accept. The peer's Open returns
+// reason as error.
+func (st *Stream) Reject(reason error) error {
+	st.mu.Lock()
+	st.closed = true
+	st.mu.Unlock()
+	st.session.remove(st.id)
+	msg := []byte(reason.Error())
+	if len(msg) > maxPayload {
+		msg = msg[:maxPayload]
+	}
+	return st.session.writeFrame(frameReset, st.id, msg)
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.consumed += uint32(n)
+			var update uint32
+			if st.consumed >= windowSize/2 && !st.readClosed {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				st.session.writeFrame(frameWindow, st.id, binary.BigEndian.AppendUint32(nil, update))
+			}
+			return n, nil
+		}
+		if st.readClosed || st.closed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		if st.writeClosed || st.reset || st.closed {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(p), int(st.sendWindow), maxPayload)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(frameData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that no more data follows
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.writeClosed || st.reset || st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	st.mu.Unlock()
+	return st.session.writeFrame(frameClose, st.id, nil)
+}
+
+// Close closes the stream. Unless both sides closed their direction
+// already, the peer sees a reset.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendReset := !st.reset && !(st.readClosed && st.writeClosed)
+	st.mu.Unlock()
+
+	st.session.remove(st.id)
+	notify(st.readable)
+	notify(st.writable)
+	if sendReset {
+		return st.session.writeFrame(frameReset, st.id, nil)
+	}
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
+
+// wait blocks until ch is signaled, the deadline passes or the session ends
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.done:
+		return st.session.err
+	}
+}
+
+func (st *Stream) receive(data []byte) {
+	st.mu.Lock()
+	if !st.closed {
+		st.buf.Write(data)
+	}
+	st.mu.Unlock()
+	notify(st.readable)
+}
+
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+// peerClosed handles a close or reset from the peer. Buffered data can
+// still be read.
+func (st *Stream) peerClosed(reset bool, reason string) {
+	st.mu.Lock()
+	st.readClosed = true
+	if reset {
+		st.reset = true
+	}
+	st.mu.Unlock()
+	if reset {
+		if reason == "" {
+			reason = "stream reset by peer"
+		}
+		select {
+		case st.opened <- errors.New(reason):
+		default:
+		}
+	}
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/mux"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An agent opens the connection with "MLCPROXY-AGENT/1 <name> <token>\n",
+// the rendezvous side answers "OK\n" or "ERR <reason>\n". After that the
+// connection carries a mux session in which the rendezvous side opens one
+// stream per outbound connection.
+const (
+	agentHello            = "MLCPROXY-AGENT/1"
+	agentHandshakeTimeout = 10 * time.Second
+)
+
+// rendezvous keeps the sessions of the connected agents
+type rendezvous struct {
+	mu       sync.Mutex
+	sessions map[string]*mux.Session // agent name -> session
+}
+
+// startRendezvous accepts agent connections on the configured address
+func (h *ProxyHandler) startRendezvous() error {
+	cfg := config.Cfg.Rendezvous
+	if len(cfg.Tokens) == 0 {
+		return fmt.Errorf("no agent tokens configured (token.<name> = ...)")
+	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12})
+	}
+
+	h.agents = &rendezvous{sessions: make(map[string]*mux.Session)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("Rendezvous listener failed: %v", err)
+				return
+			}
+			go h.agents.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// serve authenticates an agent and keeps its session until it disconnects.
+// A new connection of the same agent replaces the old one.
+func (rv *rendezvous) serve(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(agentHandshakeTimeout))
+	line, err := readLine(conn)
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 3 || fields[0] != agentHello {
+		log.Printf("Rendezvous: invalid handshake from %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	name, token := fields[1], fields[2]
+	expected, ok := config.Cfg.Rendezvous.Tokens[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		log.Printf("Rendezvous: agent %s from %s rejected - invalid token", name, conn.RemoteAddr())
+		conn.Write([]byte("ERR unauthorized\n"))
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write([]byte("OK\n")); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	session := mux.Server(conn)
+	rv.mu.Lock()
+	old := rv.sessions[name]
+	rv.sessions[name] = session
+	rv.mu.Unlock()
+	if old != nil {
+		old.Close()
+		log.Printf("Rendezvous: agent %s reconnected, old connection from %s closed", name, old.RemoteAddr())
+	}
+	log.Printf("Rendezvous: agent %s connected from %s", name, conn.RemoteAddr())
+
+	<-session.Done()
+	rv.mu.Lock()
+	if rv.sessions[name] == session {
+		delete(rv.sessions, name)
+	}
+	rv.mu.Unlock()
+	log.Printf("Rendezvous: agent %s from %s disconnected: %v", name, conn.RemoteAddr(), session.Err())
+}
+
+// dial opens a connection to addr egressing from the agent name. It is safe
+// to call on a nil rendezvous.
+func (rv *rendezvous) dial(ctx context.Context, name, addr string) (net.Conn, error) {
+	if rv == nil {
+		return nil, fmt.Errorf("agent %s: rendezvous is not enabled", name)
+	}
+	rv.mu.Lock()
+	session := rv.sessions[name]
+	rv.mu.Unlock()
+	if session == nil {
+		return nil, fmt.Errorf("agent %s is not connected", name)
+	}
+	st, err := session.Open(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("agent %s: %w", name, err)
+	}
+	return st, nil
+}
+
+// startAgent keeps a connection to the rendezvous proxy and serves the
+// streams it opens
+func (h *ProxyHandler) startAgent() error {
+	cfg := config.Cfg.Agent
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		return fmt.Errorf("invalid server %q, expected host:port", cfg.Server)
+	}
+	if cfg.Name == "" || cfg.Token == "" || strings.ContainsAny(cfg.Name+cfg.Token, " \t") {
+		return fmt.Errorf("name and token are required and must not contain spaces")
+	}
+	var tlsConfig *tls.Config
+	if cfg.TLS {
+		host, _, _ := net.SplitHostPort(cfg.Server)
+		tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if cfg.CAFile != "" {
+			pem, err := os.ReadFile(cfg.CAFile)
+			if err != nil {
+				return err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", cfg.CAFile)
+			}
+		}
+	}
+
+	go func() {
+		delay := time.Second
+		for {
+			session, err := h.connectAgent(tlsConfig)
+			if err != nil {
+				log.Printf("Agent %s: connection to %s failed, retrying in %s: %v", cfg.Name, cfg.Server, delay, err)
+				time.Sleep(delay)
+				delay = min(delay*2, cfg.MaxReconnectDelay)
+				continue
+			}
+			delay = time.Second
+			log.Printf("Agent %s: connected to rendezvous %s", cfg.Name, cfg.Server)
+			for {
+				st, err := session.Accept()
+				if err != nil {
+					break
+				}
+				go h.serveAgentStream(st)
+			}
+			log.Printf("Agent %s: connection to %s lost: %v", cfg.Name, cfg.Server, session.Err())
+			time.Sleep(delay)
+		}
+	}()
+	return nil
+}
+
+// connectAgent connects and authenticates to the rendezvous proxy
+func (h *ProxyHandler) connectAgent(tlsConfig *tls.Config) (*mux.Session, error) {
+	cfg := config.Cfg.Agent
+	ctx, cancel := context.WithTimeout(context.Background(), agentHandshakeTimeout)
+	defer cancel()
+
+	conn, err := h.dialUpstream(ctx, globalBinding(), "tcp", cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(agentHandshakeTimeout))
+	if tlsConfig != nil {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if _, err := fmt.Fprintf(conn, "%s %s %s\n", agentHello, cfg.Name, cfg.Token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if line != "OK" {
+		conn.Close()
+		return nil, fmt.Errorf("rejected by rendezvous: %s", line)
+	}
+	conn.SetDeadline(time.Time{})
+	return mux.Client(conn), nil
+}
+
+// serveAgentStream connects a stream opened by the rendezvous proxy to its
+// target. The destination ACL of this instance applies.
+func (h *ProxyHandler) serveAgentStream(st *mux.Stream) {
+	defer st.Close()
+
+	target := st.Target()
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		st.Reject(err)
+		return
+	}
+	if !h.authManager.IsDestinationAllowed(host) {
+		log.Printf("Agent: connection to %s denied - destination not allowed", target)
+		st.Reject(fmt.Errorf("destination %s not allowed", host))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cfg.Outbound.ConnectTimeout)
+	conn, err := h.dialUpstream(ctx, globalBinding(), "tcp", target)
+	cancel()
+	if err != nil {
+		log.Printf("Agent: failed to connect to %s: %v", target, err)
+		st.Reject(err)
+		return
+	}
+	defer conn.Close()
+	if err := st.Ack(); err != nil {
+		return
+	}
+	pipe(st, conn)
+}
+
+// readLine reads a handshake line byte by byte, so no data following it is
+// consumed
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 512 {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("handshake line too long")
+}
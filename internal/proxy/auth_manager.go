@@ -18,38 +18,115 @@ import (
 // AuthManager verwaltet die Authentifizierung und IP-Berechtigungen
 type AuthManager struct{}
 
-// CheckAuth prüft die Basic Authentication
+// AuthRequired liefert, ob für r Zugangsdaten nötig sind. Der Listener der
+// Anfrage kann die Einstellung aus [auth] überschreiben.
+func (am *AuthManager) AuthRequired(r *http.Request) bool {
+	if l := listenerOf(r); l != nil {
+		// Transparent clients do not know they talk to a proxy
+		if l.Protocol == "transparent" {
+			return false
+		}
+		switch l.Auth {
+		case "basic", "cert":
+			return true
+		case "none":
+			return false
+		}
+	}
+	return config.Cfg.Auth.EnableAuth
+}
+
+// CheckAuth prüft die Basic Authentication. Ein verifiziertes
+// Client-Zertifikat ersetzt die Zugangsdaten, bei auth = cert ist es Pflicht.
 func (am *AuthManager) CheckAuth(r *http.Request) bool {
-	if !config.Cfg.Auth.EnableAuth {
+	if !am.AuthRequired(r) {
+		return true
+	}
+	if _, ok := certUser(r); ok {
 		return true
 	}
+	if l := listenerOf(r); l != nil && l.Auth == "cert" {
+		return false
+	}
+	return validCredentials(r.Header.Get("Proxy-Authorization"))
+}
 
-	auth := r.Header.Get("Proxy-Authorization")
-	if auth == "" {
+// CheckAdmin prüft den Zugriff auf die Admin-API: die IP der Verbindung muss
+// erlaubt sein (ein X-Forwarded-For des Clients zählt hier nicht) und bei
+// aktivierter Authentifizierung müssen gültige Zugangsdaten im
+// Authorization- oder Proxy-Authorization-Header stehen.
+func (am *AuthManager) CheckAdmin(r *http.Request) bool {
+	if !am.IsIPAllowedIn(remoteIP(r), allowedNetworks(r)) {
 		return false
 	}
+	if !am.AuthRequired(r) {
+		return true
+	}
+	return adminCredentials(r)
+}
+
+// CheckAdminCredentials prüft wie CheckAdmin, verlangt die Zugangsdaten aber
+// auch bei abgeschalteter Authentifizierung. Für Daten anderer Clients wie
+// den HAR-Export.
+func (am *AuthManager) CheckAdminCredentials(r *http.Request) bool {
+	return am.IsIPAllowedIn(remoteIP(r), allowedNetworks(r)) && adminCredentials(r)
+}
+
+// adminCredentials prüft die Zugangsdaten im Authorization- oder
+// Proxy-Authorization-Header
+func adminCredentials(r *http.Request) bool {
+	return validCredentials(r.Header.Get("Authorization")) || validCredentials(r.Header.Get("Proxy-Authorization"))
+}
+
+// Username liefert den Benutzer aus dem Client-Zertifikat oder gültigen
+// Proxy-Zugangsdaten, sonst ""
+func (am *AuthManager) Username(r *http.Request) string {
+	if !am.AuthRequired(r) {
+		return ""
+	}
+	if user, ok := certUser(r); ok {
+		return user
+	}
+	username, ok := checkCredentials(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return ""
+	}
+	return username
+}
+
+// validCredentials prüft einen "Basic ..." Header gegen die Zugangsdaten
+func validCredentials(auth string) bool {
+	_, ok := checkCredentials(auth)
+	return ok
+}
+
+// checkCredentials prüft einen "Basic ..." Header und liefert den Benutzernamen
+func checkCredentials(auth string) (string, bool) {
+	if auth == "" {
+		return "", false
+	}
 
 	const prefix = "Basic "
 	if !strings.HasPrefix(auth, prefix) {
-		return false
+		return "", false
 	}
 
 	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
 	if err != nil {
-		return false
+		return "", false
 	}
 
 	credentials := strings.SplitN(string(decoded), ":", 2)
 	if len(credentials) != 2 {
-		return false
+		return "", false
 	}
 
 	username, password := credentials[0], credentials[1]
 	if storedPass, ok := config.Cfg.Auth.Credentials[username]; ok {
-		return password == storedPass
+		return username, password == storedPass
 	}
 
-	return false
+	return "", false
 }
 
 // RequireAuth sendet den Auth-Header
@@ -60,7 +137,12 @@ func (am *AuthManager) RequireAuth(w http.ResponseWriter) {
 
 // IsIPAllowed prüft ob die IP-Adresse in den erlaubten Netzwerken liegt
 func (am *AuthManager) IsIPAllowed(ipStr string) bool {
-	if len(config.Cfg.Security.AllowedNetworks) == 0 {
+	return am.IsIPAllowedIn(ipStr, config.Cfg.Security.AllowedNetworks)
+}
+
+// IsIPAllowedIn prüft ob die IP-Adresse in einem der Netzwerke liegt
+func (am *AuthManager) IsIPAllowedIn(ipStr string, networks []string) bool {
+	if len(networks) == 0 {
 		return true
 	}
 
@@ -86,7 +168,7 @@ func (am *AuthManager) IsIPAllowed(ipStr string) bool {
 		clientIP = ip4
 	}
 
-	for _, network := range config.Cfg.Security.AllowedNetworks {
+	for _, network := range networks {
 		_, ipNet, err := net.ParseCIDR(network)
 		if err != nil {
 			log.Printf("Warnung: Ungültiges Netzwerk in Konfiguration: %s", network)
@@ -98,6 +180,54 @@ func (am *AuthManager) IsIPAllowed(ipStr string) bool {
 	}
 
 	log.Printf("Zugriff verweigert für IP %s - nicht in erlaubten Netzwerken: %v",
-		host, config.Cfg.Security.AllowedNetworks)
+		host, networks)
 	return false
 }
+
+// IsDestinationAllowed prüft den Zielhost (Host-Header, CONNECT-Ziel oder SNI)
+// gegen die Ziel-ACLs. Muster wie "*.example.com" oder ".example.com" treffen
+// die Domain selbst und alle Subdomains, sonst wird exakt verglichen.
+func (am *AuthManager) IsDestinationAllowed(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+
+	for _, pattern := range config.Cfg.Security.DeniedDestinations {
+		if matchHostPattern(pattern, host) {
+			return false
+		}
+	}
+	if len(config.Cfg.Security.AllowedDestinations) == 0 {
+		return true
+	}
+	for _, pattern := range config.Cfg.Security.AllowedDestinations {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHostList prüft, ob host auf eines der Muster passt
+func matchHostList(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHostPattern vergleicht einen Hostnamen mit einem ACL-Muster
+func matchHostPattern(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") || strings.HasPrefix(pattern, ".") {
+		domain := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+	return host == pattern
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"mlc_goproxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckAdmin(t *testing.T) {
+	savedAuth, savedSecurity := config.Cfg.Auth, config.Cfg.Security
+	t.Cleanup(func() { config.Cfg.Auth, config.Cfg.Security = savedAuth, savedSecurity })
+	config.Cfg.Auth.Credentials = map[string]string{"admin": "secret"}
+	config.Cfg.Security.AllowedNetworks = []string{"192.168.0.0/16"}
+
+	tests := []struct {
+		name            string
+		enableAuth      bool
+		remote          string
+		xff             string
+		user, password  string
+		wantAdmin       bool
+		wantCredentials bool // CheckAdminCredentials, used by the HAR export
+	}{
+		{name: "auth off", remote: "192.168.1.2:4711", wantAdmin: true},
+		{name: "auth off with credentials", remote: "192.168.1.2:4711", user: "admin", password: "secret", wantAdmin: true, wantCredentials: true},
+		{name: "auth off wrong password", remote: "192.168.1.2:4711", user: "admin", password: "guess", wantAdmin: true},
+		{name: "auth on without credentials", enableAuth: true, remote: "192.168.1.2:4711"},
+		{name: "auth on with credentials", enableAuth: true, remote: "192.168.1.2:4711", user: "admin", password: "secret", wantAdmin: true, wantCredentials: true},
+		{name: "other network", remote: "203.0.113.5:4711", user: "admin", password: "secret"},
+		{name: "forged X-Forwarded-For", remote: "203.0.113.5:4711", xff: "192.168.1.2", user: "admin", password: "secret"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Cfg.Auth.EnableAuth = tc.enableAuth
+			r := httptest.NewRequest(http.MethodGet, "/stat/capture.har", nil)
+			r.RemoteAddr = tc.remote
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if tc.user != "" {
+				r.SetBasicAuth(tc.user, tc.password)
+			}
+			am := &AuthManager{}
+			if got := am.CheckAdmin(r); got != tc.wantAdmin {
+				t.Errorf("CheckAdmin() = %v, want %v", got, tc.wantAdmin)
+			}
+			if got := am.CheckAdminCredentials(r); got != tc.wantCredentials {
+				t.Errorf("CheckAdminCredentials() = %v, want %v", got, tc.wantCredentials)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import "syscall"
+
+// bindToDevice returns a dialer control function that binds the socket to
+// the network interface iface (SO_BINDTODEVICE)
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDevice is only available on Linux
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, fmt.Errorf("binding to interface %s is only supported on Linux", iface)
+}
@@ -0,0 +1,259 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mlc_goproxy/internal/config"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// errResponseTooLarge is returned by the size limiter once max_response_size is exceeded
+var errResponseTooLarge = errors.New("response exceeds max_response_size")
+
+// errRewriteTooLarge is returned by rewriteBody for bodies above
+// max_rewrite_size. They are blocked, passing them on would skip the rules.
+var errRewriteTooLarge = errors.New("body larger than max_rewrite_size")
+
+// errRewriteFailed is wrapped by rewriteBody errors after the body has been
+// consumed; the response cannot be forwarded anymore
+var errRewriteFailed = errors.New("body filter failed")
+
+// filterRule is a compiled config.FilterRule
+type filterRule struct {
+	config.FilterRule
+	replace []*regexReplace
+}
+
+// compileFilterRules validates the configured body filter rules
+func compileFilterRules(rules []config.FilterRule) ([]*filterRule, error) {
+	var compiled []*filterRule
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		rule := &filterRule{FilterRule: r}
+		for _, spec := range r.Replace {
+			rr, err := compileRegexReplace(spec)
+			if err != nil {
+				return nil, fmt.Errorf("filter rule %s: %w", r.Name, err)
+			}
+			rule.replace = append(rule.replace, rr)
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+func (rule *filterRule) matches(host, mediaType string) bool {
+	if len(rule.Hosts) > 0 && !matchHostList(rule.Hosts, host) {
+		return false
+	}
+	return len(rule.ContentTypes) == 0 || matchMediaType(rule.ContentTypes, mediaType)
+}
+
+// filterResponse runs the body filter pipeline on resp. It returns a status
+// code and reason if the response must be blocked, otherwise it may replace
+// resp.Body and adjust the headers.
+func (h *ProxyHandler) filterResponse(r *http.Request, resp *http.Response) (int, string) {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	// Block by MIME type
+	if matchMediaType(config.Cfg.Filter.BlockedTypes, mediaType) {
+		return http.StatusForbidden, fmt.Sprintf("Content type %s is blocked", mediaType)
+	}
+
+	// Block by size: known length up front, otherwise while streaming
+	if limit := config.Cfg.Filter.MaxResponseSize; limit > 0 {
+		if resp.ContentLength > limit {
+			return http.StatusForbidden, fmt.Sprintf("Response size %d exceeds limit of %d bytes", resp.ContentLength, limit)
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{&sizeLimitReader{r: resp.Body, remaining: limit}, resp.Body}
+	}
+
+	// Text substitution, bodies of other content types are streamed
+	// untouched
+	var replacements []*regexReplace
+	host := hostname(r.Host)
+	for _, rule := range h.filters {
+		if rule.matches(host, mediaType) {
+			replacements = append(replacements, rule.replace...)
+		}
+	}
+	if len(replacements) == 0 {
+		return 0, ""
+	}
+	err := rewriteBody(resp, replacements)
+	switch {
+	case err == nil:
+	case errors.Is(err, errResponseTooLarge):
+		return http.StatusForbidden, fmt.Sprintf("Response exceeds limit of %d bytes", config.Cfg.Filter.MaxResponseSize)
+	case errors.Is(err, errRewriteTooLarge):
+		return http.StatusForbidden, fmt.Sprintf("Response exceeds max_rewrite_size of %d bytes and cannot be filtered", config.Cfg.Filter.MaxRewriteSize)
+	case errors.Is(err, errRewriteFailed):
+		return http.StatusBadGateway, err.Error()
+	default:
+		log.Printf("Body filter skipped for %s: %v", r.Host, err)
+	}
+	return 0, ""
+}
+
+// rewriteBody buffers the body, decodes it, applies the replacements and
+// re-encodes it with the original Content-Encoding. max_rewrite_size is a
+// hard cap on the encoded and the decoded body: larger bodies yield
+// errRewriteTooLarge. Bodies that cannot be decoded are passed through
+// unchanged. Errors after the body was consumed wrap errRewriteFailed.
+func rewriteBody(resp *http.Response, replacements []*regexReplace) error {
+	limit := config.Cfg.Filter.MaxRewriteSize
+	if resp.ContentLength > int64(limit) {
+		return errRewriteTooLarge
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "identity" && encoding != "gzip" && encoding != "deflate" && encoding != "br" {
+		return fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return fmt.Errorf("%w: reading body: %w", errRewriteFailed, err)
+	}
+	if len(raw) > limit {
+		return errRewriteTooLarge
+	}
+
+	body, err := decodeBody(raw, encoding, limit)
+	if errors.Is(err, errRewriteTooLarge) {
+		return err
+	}
+	if err != nil {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{bytes.NewReader(raw), resp.Body}
+		return err
+	}
+	for _, rr := range replacements {
+		body = rr.re.ReplaceAll(body, []byte(rr.replacement))
+	}
+	if raw, err = encodeBody(body, encoding); err != nil {
+		return fmt.Errorf("%w: encoding body: %w", errRewriteFailed, err)
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(raw), resp.Body}
+	resp.ContentLength = int64(len(raw))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(raw)))
+	return nil
+}
+
+// decodeBody decodes data, failing with errRewriteTooLarge if the result
+// exceeds limit bytes
+func decodeBody(data []byte, encoding string, limit int) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(data))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err == nil && len(body) > limit {
+		return nil, errRewriteTooLarge
+	}
+	return body, err
+}
+
+func encodeBody(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		return data, nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// matchMediaType compares a media type with a list like "text/html,application/*"
+func matchMediaType(patterns []string, mediaType string) bool {
+	if mediaType == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeLimitReader fails with errResponseTooLarge after a number of bytes
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (s *sizeLimitReader) Read(p []byte) (int, error) {
+	if s.remaining <= 0 {
+		// Allow a clean EOF exactly at the limit
+		var probe [1]byte
+		if n, err := s.r.Read(probe[:]); n == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= int64(n)
+	return n, err
+}
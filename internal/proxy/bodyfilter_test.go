@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mlc_goproxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestFilterResponse(t *testing.T) {
+	saved := config.Cfg.Filter
+	t.Cleanup(func() { config.Cfg.Filter = saved })
+	config.Cfg.Filter.BlockedTypes = []string{"application/x-msdownload"}
+	config.Cfg.Filter.MaxRewriteSize = 64
+
+	filters, err := compileFilterRules([]config.FilterRule{{
+		Name: "kiosk", Enabled: true, ContentTypes: []string{"text/html"}, Replace: []string{"kaufen => ansehen"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &ProxyHandler{filters: filters}
+
+	tests := []struct {
+		name         string
+		contentType  string
+		encoding     string
+		body         io.Reader
+		maxResponse  int64
+		wantStatus   int
+		wantBody     string
+		wantEncoding bool // body is gzip encoded
+	}{
+		{name: "replaced", contentType: "text/html; charset=utf-8", body: strings.NewReader("jetzt kaufen"), wantBody: "jetzt ansehen"},
+		{name: "replaced gzip", contentType: "text/html", encoding: "gzip", body: strings.NewReader(gzipped(t, "jetzt kaufen")), wantBody: "jetzt ansehen", wantEncoding: true},
+		{name: "other type untouched", contentType: "text/plain", body: strings.NewReader("jetzt kaufen"), wantBody: "jetzt kaufen"},
+		{name: "larger than max_rewrite_size", contentType: "text/html", body: strings.NewReader(strings.Repeat("kaufen ", 20)), wantStatus: http.StatusForbidden},
+		{name: "larger than max_rewrite_size decoded", contentType: "text/html", encoding: "gzip", body: strings.NewReader(gzipped(t, strings.Repeat("kaufen ", 20))), wantStatus: http.StatusForbidden},
+		{name: "other type larger than max_rewrite_size", contentType: "image/png", body: strings.NewReader(strings.Repeat("x", 100)), wantBody: strings.Repeat("x", 100)},
+		{name: "undecodable", contentType: "text/html", encoding: "gzip", body: strings.NewReader("kaufen, not gzip"), wantBody: "kaufen, not gzip"},
+		{name: "unsupported encoding", contentType: "text/html", encoding: "zstd", body: strings.NewReader("kaufen"), wantBody: "kaufen"},
+		{name: "blocked type", contentType: "application/x-msdownload", body: strings.NewReader("MZ"), wantStatus: http.StatusForbidden},
+		{name: "read error", contentType: "text/html", body: io.MultiReader(strings.NewReader("kau"), iotest.ErrReader(errors.New("connection reset"))), wantStatus: http.StatusBadGateway},
+		{name: "too large while buffering", contentType: "text/html", body: strings.NewReader("jetzt kaufen"), maxResponse: 5, wantStatus: http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Cfg.Filter.MaxResponseSize = tc.maxResponse
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": {tc.contentType}},
+				Body:          io.NopCloser(tc.body),
+				ContentLength: -1,
+			}
+			if tc.encoding != "" {
+				resp.Header.Set("Content-Encoding", tc.encoding)
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://shop.example.com/", nil)
+
+			status, reason := h.filterResponse(r, resp)
+			if status != tc.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", status, reason, tc.wantStatus)
+			}
+			if status != 0 {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantEncoding {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != tc.wantBody {
+				t.Errorf("body = %q, want %q", body, tc.wantBody)
+			}
+		})
+	}
+}
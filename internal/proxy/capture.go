@@ -0,0 +1,198 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"io"
+	"mlc_goproxy/internal/capture"
+	"mlc_goproxy/internal/config"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// exchangeCapture collects the data of one HTTP exchange for the HAR recorder.
+// All methods are safe to call on a nil receiver, which means "not captured".
+type exchangeCapture struct {
+	entry        *capture.Entry
+	requestBody  *capture.LimitedBuffer
+	responseBody *capture.LimitedBuffer
+	wroteRequest time.Time
+	firstByte    time.Time
+	responseDone time.Time
+}
+
+// startCapture begins recording r if capturing is enabled and the client
+// and host match the configured filters. It tees the request body.
+func (h *ProxyHandler) startCapture(r *http.Request) *exchangeCapture {
+	if h.recorder == nil || !captureMatches(r) {
+		return nil
+	}
+
+	c := &exchangeCapture{
+		entry: &capture.Entry{
+			Started:  time.Now(),
+			ClientIP: getClientIP(r),
+		},
+		requestBody:  capture.NewLimitedBuffer(h.recorder.MaxBody()),
+		responseBody: capture.NewLimitedBuffer(h.recorder.MaxBody()),
+	}
+	if r.Body != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, c.requestBody), r.Body}
+	}
+	return c
+}
+
+// traceRequest attaches an httptrace to req to measure the HAR timings
+func (c *exchangeCapture) traceRequest(req *http.Request) *http.Request {
+	if c == nil {
+		return req
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				c.entry.ServerAddr = host
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			c.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			c.firstByte = time.Now()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// teeResponse returns a reader that copies the response body into the capture
+func (c *exchangeCapture) teeResponse(body io.Reader) io.Reader {
+	if c == nil {
+		return body
+	}
+	return io.TeeReader(body, c.responseBody)
+}
+
+// finish completes the entry and hands it to the recorder
+func (c *exchangeCapture) finish(rec *capture.Recorder, req *http.Request, resp *http.Response, requestBytes, responseBytes int64) {
+	if c == nil {
+		return
+	}
+	c.responseDone = time.Now()
+
+	e := c.entry
+	e.Method = req.Method
+	e.URL = req.URL.String()
+	e.Proto = req.Proto
+	e.RequestHeader = redactHeaders(req.Header)
+	e.RequestBody = c.requestBody.Bytes()
+	e.RequestSize = requestBytes
+	e.Status = resp.StatusCode
+	e.StatusText = http.StatusText(resp.StatusCode)
+	e.ResponseProto = resp.Proto
+	e.ResponseHeader = redactHeaders(resp.Header)
+	e.ResponseBody = c.responseBody.Bytes()
+	e.ResponseSize = responseBytes
+	e.Truncated = c.requestBody.Truncated || c.responseBody.Truncated
+
+	if !c.wroteRequest.IsZero() {
+		e.Send = c.wroteRequest.Sub(e.Started)
+		if !c.firstByte.IsZero() {
+			e.Wait = c.firstByte.Sub(c.wroteRequest)
+			e.Receive = c.responseDone.Sub(c.firstByte)
+		}
+	}
+	rec.Add(e)
+}
+
+// redactedHeaders carry credentials and session tokens, their values are
+// not stored in captures
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redactHeaders returns a copy of h with the values of redactedHeaders
+// replaced
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		for i := range h[name] {
+			h[name][i] = "[redacted]"
+		}
+	}
+	return h
+}
+
+// captureMatches checks the client and host filters of the capture config
+func captureMatches(r *http.Request) bool {
+	if len(config.Cfg.Capture.Clients) > 0 && !ipInList(getClientIP(r), config.Cfg.Capture.Clients) {
+		return false
+	}
+	return len(config.Cfg.Capture.Hosts) == 0 || matchHostList(config.Cfg.Capture.Hosts, hostname(r.Host))
+}
+
+// ipInList reports whether ipStr equals one of the IPs or lies in one of the
+// CIDR networks in list
+func ipInList(ipStr string, list []string) bool {
+	ip := net.ParseIP(strings.Trim(ipStr, "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, entry := range list {
+		if strings.Contains(entry, "/") {
+			if _, ipNet, err := net.ParseCIDR(entry); err == nil && ipNet.Contains(ip) {
+				return true
+			}
+		} else if other := net.ParseIP(entry); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHARExport serves the captured exchanges as HAR 1.2. The time range
+// can be limited with "from"/"to" (RFC 3339) or "since" (duration, e.g. 15m).
+func (h *ProxyHandler) handleHARExport(w http.ResponseWriter, r *http.Request) {
+	// The export holds bodies and headers of other clients, credentials are
+	// required even with enable_auth = false
+	if !h.authManager.CheckAdminCredentials(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="MLCProxy Admin"`)
+		http.Error(w, "Admin access denied", http.StatusUnauthorized)
+		return
+	}
+	if h.recorder == nil {
+		http.Error(w, "Capture is disabled", http.StatusNotFound)
+		return
+	}
+
+	var from, to time.Time
+	query := r.URL.Query()
+	if s := query.Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, "Invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = time.Now().Add(-d)
+	}
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if s := query.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, "Invalid "+name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*target = t
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=mlcproxy-"+time.Now().Format("20060102-150405")+".har")
+	capture.WriteHAR(w, h.recorder.Entries(from, to))
+}
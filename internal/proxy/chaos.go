@@ -0,0 +1,284 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"mlc_goproxy/internal/config"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errChaosDrop is returned by the fault reader once the drop limit is reached
+var errChaosDrop = errors.New("connection dropped by chaos rule")
+
+// chaosEngine holds the fault injection rules and their runtime state
+type chaosEngine struct {
+	mu      sync.RWMutex
+	enabled bool
+	rules   []*chaosRule
+}
+
+type chaosRule struct {
+	config.ChaosRule
+	enabled bool
+}
+
+// ChaosRuleState is the JSON representation of a rule for the admin API
+type ChaosRuleState struct {
+	Name        string   `json:"name"`
+	Enabled     bool     `json:"enabled"`
+	Clients     []string `json:"clients,omitempty"`
+	Hosts       []string `json:"hosts,omitempty"`
+	PathPrefix  string   `json:"path_prefix,omitempty"`
+	Probability float64  `json:"probability"`
+	Latency     string   `json:"latency,omitempty"`
+	Jitter      string   `json:"jitter,omitempty"`
+	Throttle    int      `json:"throttle,omitempty"`
+	DropAfter   int64    `json:"drop_after,omitempty"`
+	Status      int      `json:"status,omitempty"`
+	ResetTunnel bool     `json:"reset_tunnel,omitempty"`
+}
+
+// newChaosEngine creates the engine from the configured rules. Disabled
+// rules are validated as well, they can be switched on at runtime.
+func newChaosEngine(enabled bool, rules []config.ChaosRule) (*chaosEngine, error) {
+	e := &chaosEngine{enabled: enabled}
+	for _, r := range rules {
+		if err := validateChaosRule(r); err != nil {
+			return nil, fmt.Errorf("chaos rule %s: %w", r.Name, err)
+		}
+		e.rules = append(e.rules, &chaosRule{ChaosRule: r, enabled: r.Enabled})
+	}
+	return e, nil
+}
+
+// validateChaosRule rejects values that would break the handlers
+func validateChaosRule(r config.ChaosRule) error {
+	switch {
+	case r.Status != 0 && (r.Status < 200 || r.Status > 599):
+		// 1xx are no final responses, the client would wait for one
+		return fmt.Errorf("invalid status %d, expected 200-599 or 0", r.Status)
+	case r.Probability < 0 || r.Probability > 1 || math.IsNaN(r.Probability):
+		return fmt.Errorf("invalid probability %v, expected 0-1", r.Probability)
+	case r.Latency < 0 || r.Jitter < 0:
+		return fmt.Errorf("latency and jitter must not be negative")
+	case r.Throttle < 0:
+		return fmt.Errorf("invalid throttle %d, expected bytes per second or 0", r.Throttle)
+	case r.DropAfter < 0:
+		return fmt.Errorf("invalid drop_after %d, expected bytes or 0", r.DropAfter)
+	}
+	return nil
+}
+
+// match returns the fault of the first enabled rule matching r whose
+// probability roll succeeds, or nil
+func (e *chaosEngine) match(r *http.Request) *chaosFault {
+	if e == nil {
+		return nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.enabled {
+		return nil
+	}
+
+	clientIP := getClientIP(r)
+	host := hostname(r.Host)
+
+	for _, rule := range e.rules {
+		if !rule.enabled || !rule.matches(clientIP, host, r.URL.Path) {
+			continue
+		}
+		if rule.Probability < 1 && rand.Float64() >= rule.Probability {
+			continue
+		}
+		return &chaosFault{rule: rule.ChaosRule}
+	}
+	return nil
+}
+
+func (r *chaosRule) matches(clientIP, host, path string) bool {
+	if len(r.Clients) > 0 && !ipInList(clientIP, r.Clients) {
+		return false
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(path, r.PathPrefix) {
+		return false
+	}
+	return len(r.Hosts) == 0 || matchHostList(r.Hosts, host)
+}
+
+// setEnabled switches the whole engine (name "") or a single rule
+func (e *chaosEngine) setEnabled(name string, enabled bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if name == "" {
+		e.enabled = enabled
+		return nil
+	}
+	for _, rule := range e.rules {
+		if rule.Name == name {
+			rule.enabled = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown chaos rule %q", name)
+}
+
+// state returns the engine state for the admin API
+func (e *chaosEngine) state() (bool, []ChaosRuleState) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	rules := make([]ChaosRuleState, 0, len(e.rules))
+	for _, r := range e.rules {
+		state := ChaosRuleState{
+			Name:        r.Name,
+			Enabled:     r.enabled,
+			Clients:     r.Clients,
+			Hosts:       r.Hosts,
+			PathPrefix:  r.PathPrefix,
+			Probability: r.Probability,
+			Throttle:    r.Throttle,
+			DropAfter:   r.DropAfter,
+			Status:      r.Status,
+			ResetTunnel: r.ResetTunnel,
+		}
+		if r.Latency > 0 {
+			state.Latency = r.Latency.String()
+		}
+		if r.Jitter > 0 {
+			state.Jitter = r.Jitter.String()
+		}
+		rules = append(rules, state)
+	}
+	return e.enabled, rules
+}
+
+// chaosFault is the fault selected for one request. Methods are safe to call
+// on a nil receiver, which means "no fault".
+type chaosFault struct {
+	rule config.ChaosRule
+}
+
+// delay sleeps for the configured latency plus jitter
+func (f *chaosFault) delay() {
+	if f == nil {
+		return
+	}
+	d := f.rule.Latency
+	if f.rule.Jitter > 0 {
+		d += rand.N(f.rule.Jitter)
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// status returns the synthetic status code, 0 if the request passes through
+func (f *chaosFault) status() int {
+	if f == nil {
+		return 0
+	}
+	return f.rule.Status
+}
+
+// resetTunnel reports whether a CONNECT tunnel is reset right after setup
+func (f *chaosFault) resetTunnel() bool {
+	return f != nil && f.rule.ResetTunnel && f.rule.DropAfter == 0
+}
+
+// wrap applies throttling and the drop limit to a response stream
+func (f *chaosFault) wrap(r io.Reader) io.Reader {
+	if f == nil {
+		return r
+	}
+	if f.rule.DropAfter > 0 {
+		r = &dropReader{r: r, remaining: f.rule.DropAfter}
+	}
+	if f.rule.Throttle > 0 {
+		r = &throttledReader{r: r, rate: f.rule.Throttle, start: time.Now()}
+	}
+	return r
+}
+
+// String describes the rule for log messages
+func (f *chaosFault) String() string {
+	if f == nil {
+		return "none"
+	}
+	return "chaos rule " + f.rule.Name
+}
+
+// resetConn closes c with a TCP RST instead of a normal FIN
+func resetConn(c net.Conn) {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	if pc, ok := c.(*proxyProtoConn); ok {
+		c = pc.Conn
+	}
+	if tcp, ok := c.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	c.Close()
+}
+
+// dropReader fails with errChaosDrop after a number of bytes
+type dropReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (d *dropReader) Read(p []byte) (int, error) {
+	if d.remaining <= 0 {
+		return 0, errChaosDrop
+	}
+	if int64(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.r.Read(p)
+	d.remaining -= int64(n)
+	return n, err
+}
+
+// throttledReader limits the read rate to rate bytes per second
+type throttledReader struct {
+	r     io.Reader
+	rate  int
+	start time.Time
+	total int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Read in small chunks so the rate stays smooth
+	if chunk := t.rate/10 + 1; len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.r.Read(p)
+	t.total += int64(n)
+	expected := time.Duration(float64(t.total) / float64(t.rate) * float64(time.Second))
+	if wait := expected - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// logChaos logs that a fault has been applied
+func logChaos(f *chaosFault, r *http.Request, action string) {
+	log.Printf("%s: %s for %s %s", f, action, r.Method, r.Host)
+}
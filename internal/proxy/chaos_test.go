@@ -0,0 +1,52 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"math"
+	"mlc_goproxy/internal/config"
+	"testing"
+	"time"
+)
+
+func TestNewChaosEngineValidation(t *testing.T) {
+	valid := config.ChaosRule{Name: "test", Probability: 1}
+	tests := []struct {
+		name    string
+		modify  func(*config.ChaosRule)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(*config.ChaosRule) {}},
+		{name: "status", modify: func(r *config.ChaosRule) { r.Status = 503 }},
+		{name: "all faults", modify: func(r *config.ChaosRule) {
+			r.Probability, r.Latency, r.Jitter, r.Throttle, r.DropAfter = 0.5, time.Second, time.Second, 1024, 100
+		}},
+		{name: "status too low", modify: func(r *config.ChaosRule) { r.Status = 42 }, wantErr: true},
+		{name: "status too high", modify: func(r *config.ChaosRule) { r.Status = 600 }, wantErr: true},
+		{name: "informational status", modify: func(r *config.ChaosRule) { r.Status = 103 }, wantErr: true},
+		{name: "lowest status", modify: func(r *config.ChaosRule) { r.Status = 200 }},
+		{name: "highest status", modify: func(r *config.ChaosRule) { r.Status = 599 }},
+		{name: "negative status", modify: func(r *config.ChaosRule) { r.Status = -503 }, wantErr: true},
+		{name: "probability above 1", modify: func(r *config.ChaosRule) { r.Probability = 1.5 }, wantErr: true},
+		{name: "negative probability", modify: func(r *config.ChaosRule) { r.Probability = -0.1 }, wantErr: true},
+		{name: "NaN probability", modify: func(r *config.ChaosRule) { r.Probability = math.NaN() }, wantErr: true},
+		{name: "negative latency", modify: func(r *config.ChaosRule) { r.Latency = -time.Second }, wantErr: true},
+		{name: "negative throttle", modify: func(r *config.ChaosRule) { r.Throttle = -1 }, wantErr: true},
+		{name: "negative drop_after", modify: func(r *config.ChaosRule) { r.DropAfter = -1 }, wantErr: true},
+		{name: "disabled rule is checked", modify: func(r *config.ChaosRule) { r.Enabled, r.Status = false, 7 }, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := valid
+			tc.modify(&rule)
+			_, err := newChaosEngine(true, []config.ChaosRule{rule})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("err = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
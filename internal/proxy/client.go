@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ClientOptions configures client mode: local ports that are tunneled to
+// targets through a remote proxy with CONNECT
+type ClientOptions struct {
+	Proxy       *url.URL    // http:// or https://, user info is sent as Basic auth
+	TLS         *tls.Config // for https proxies, nil = system roots
+	Forwards    []ClientForward
+	DialTimeout time.Duration // per connection attempt to the proxy
+	RetryFor    time.Duration // keep retrying to open a tunnel this long
+}
+
+// ClientForward is a local address tunneled to Target
+type ClientForward struct {
+	Listen string // local host:port
+	Target string // host:port as seen from the proxy
+}
+
+// ParseClientForward parses an ssh style forward [bind:]port:host:hostport.
+// Without bind the port is opened on 127.0.0.1.
+func ParseClientForward(spec string) (ClientForward, error) {
+	invalid := fmt.Errorf("invalid forward %q, expected [bind:]port:host:hostport", spec)
+
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return ClientForward{}, invalid
+	}
+	rest, targetPort := spec[:i], spec[i+1:]
+	var targetHost string
+	if strings.HasSuffix(rest, "]") {
+		j := strings.LastIndex(rest, "[")
+		if j < 1 {
+			return ClientForward{}, invalid
+		}
+		rest, targetHost = rest[:j-1], rest[j+1:len(rest)-1]
+	} else {
+		j := strings.LastIndex(rest, ":")
+		if j < 0 {
+			return ClientForward{}, invalid
+		}
+		rest, targetHost = rest[:j], rest[j+1:]
+	}
+
+	listen := net.JoinHostPort("127.0.0.1", rest)
+	if strings.Contains(rest, ":") {
+		listen = rest
+		if strings.HasPrefix(listen, ":") {
+			listen = "0.0.0.0" + listen
+		}
+	}
+	if _, port, err := net.SplitHostPort(listen); err != nil || port == "" || targetHost == "" || targetPort == "" {
+		return ClientForward{}, invalid
+	}
+	return ClientForward{Listen: listen, Target: net.JoinHostPort(targetHost, targetPort)}, nil
+}
+
+// RunClient opens the local ports of opts and tunnels each accepted
+// connection through the proxy until a listener fails
+func RunClient(opts ClientOptions) error {
+	if len(opts.Forwards) == 0 {
+		return fmt.Errorf("no forward configured")
+	}
+	var listeners []net.Listener
+	for _, fwd := range opts.Forwards {
+		ln, err := net.Listen("tcp", fwd.Listen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		fwd := opts.Forwards[i]
+		log.Printf("Forwarding %s to %s via %s", ln.Addr(), fwd.Target, opts.Proxy.Redacted())
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					errs <- fmt.Errorf("%s: %w", fwd.Listen, err)
+					return
+				}
+				go opts.handle(conn, fwd.Target)
+			}
+		}()
+	}
+	return <-errs
+}
+
+// handle tunnels one local connection to target. A tunnel that breaks is
+// not reopened, the stream state is lost; the local connection is closed so
+// the application notices and reconnects.
+func (opts *ClientOptions) handle(conn net.Conn, target string) {
+	defer conn.Close()
+
+	tunnel, err := opts.connect(target)
+	if err != nil {
+		log.Printf("Tunnel from %s to %s failed: %v", conn.RemoteAddr(), target, err)
+		return
+	}
+	defer tunnel.Close()
+
+	log.Printf("Tunnel from %s to %s established", conn.RemoteAddr(), target)
+	sent, received := pipe(conn, tunnel)
+	log.Printf("Tunnel from %s to %s closed (%d bytes sent, %d received)", conn.RemoteAddr(), target, sent, received)
+}
+
+// connect opens a tunnel to target. Failed attempts are retried with
+// increasing delays for up to opts.RetryFor, so a restarting proxy does not
+// break new connections. Client errors from the proxy (e.g. 407) are final.
+func (opts *ClientOptions) connect(target string) (net.Conn, error) {
+	giveUp := time.Now().Add(opts.RetryFor)
+	delay := time.Second
+	for {
+		conn, err := opts.dial(target)
+		var connectErr *connectError
+		if err == nil || (errors.As(err, &connectErr) && connectErr.status < http.StatusInternalServerError) {
+			return conn, err
+		}
+		if time.Now().Add(delay).After(giveUp) {
+			return nil, err
+		}
+		log.Printf("Tunnel to %s failed, retrying in %s: %v", target, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+// dial makes one attempt to open a tunnel to target
+func (opts *ClientOptions) dial(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.DialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", opts.Proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	return connectVia(ctx, conn, opts.Proxy, opts.TLS, target)
+}
@@ -0,0 +1,347 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// outboundBinding selects the source address and network interface of
+// upstream connections. The zero value lets the OS decide.
+type outboundBinding struct {
+	sourceIP string
+	iface    string
+	agent    string // connect through this agent instead (see agent.go)
+}
+
+// outboundFor returns the binding for r: the first matching route in
+// [outbound.<name>], otherwise the global setting
+func (h *ProxyHandler) outboundFor(r *http.Request) outboundBinding {
+	if l := listenerOf(r); l != nil && l.Agent != "" {
+		// The agent's own outbound settings apply
+		return outboundBinding{agent: l.Agent}
+	}
+	host := hostname(r.Host)
+	var user string
+	for _, route := range config.Cfg.Outbound.Routes {
+		if !route.Enabled || !routeEnabled(r, route.Name) || (len(route.Hosts) > 0 && !matchHostList(route.Hosts, host)) {
+			continue
+		}
+		if len(route.Users) > 0 {
+			if user == "" {
+				user = h.authManager.Username(r)
+			}
+			if !slices.Contains(route.Users, user) {
+				continue
+			}
+		}
+		return outboundBinding{sourceIP: route.SourceIP, iface: route.Interface}
+	}
+	return globalBinding()
+}
+
+// globalBinding returns the binding configured in [outbound]
+func globalBinding() outboundBinding {
+	return outboundBinding{sourceIP: config.Cfg.Outbound.SourceIP, iface: config.Cfg.Outbound.Interface}
+}
+
+// validateOutbound checks the configured source addresses and interfaces
+func validateOutbound() error {
+	bindings := []config.OutboundRoute{{Name: "global", SourceIP: config.Cfg.Outbound.SourceIP, Interface: config.Cfg.Outbound.Interface}}
+	for _, route := range config.Cfg.Outbound.Routes {
+		if route.Enabled {
+			bindings = append(bindings, route)
+		}
+	}
+	// Without a limit every connection attempt would fail at once
+	if config.Cfg.Outbound.AttemptTimeout <= 0 {
+		return fmt.Errorf("outbound: attempt_timeout must be positive, not %s", config.Cfg.Outbound.AttemptTimeout)
+	}
+	if config.Cfg.Outbound.ConnectTimeout <= 0 {
+		return fmt.Errorf("outbound: connect_timeout must be positive, not %s", config.Cfg.Outbound.ConnectTimeout)
+	}
+	if v := config.Cfg.Outbound.ProxyProtocolVersion; v != 1 && v != 2 {
+		return fmt.Errorf("outbound: proxy_protocol_version must be 1 or 2, not %d", v)
+	}
+	for _, b := range bindings {
+		if b.SourceIP != "" && net.ParseIP(b.SourceIP) == nil {
+			return fmt.Errorf("outbound %s: invalid source_ip %q", b.Name, b.SourceIP)
+		}
+		if b.Interface != "" {
+			if _, err := bindToDevice(b.Interface); err != nil {
+				return fmt.Errorf("outbound %s: %w", b.Name, err)
+			}
+			if _, err := net.InterfaceByName(b.Interface); err != nil {
+				log.Printf("Warning: outbound interface %s not found (yet): %v", b.Interface, err)
+			}
+		}
+	}
+	return nil
+}
+
+// transportFor returns the transport for upstream HTTP requests using b.
+// Every binding gets its own transport so pooled connections are not
+// shared between bindings.
+func (h *ProxyHandler) transportFor(b outboundBinding) *http.Transport {
+	if t, ok := h.transports.Load(b); ok {
+		return t.(*http.Transport)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return h.dialUpstream(ctx, b, network, addr)
+	}
+	actual, _ := h.transports.LoadOrStore(b, t)
+	return actual.(*http.Transport)
+}
+
+// dialer returns a dialer with the source address and interface of b
+func (b outboundBinding) dialer() *net.Dialer {
+	d := &net.Dialer{}
+	if ip := net.ParseIP(b.sourceIP); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if b.iface != "" {
+		// Validated at startup
+		d.Control, _ = bindToDevice(b.iface)
+	}
+	return d
+}
+
+// dialUpstream connects to addr using binding b. Hostnames are resolved with
+// the configured resolver, or by the net package if none is set. The
+// addresses are ordered by the configured IP preference and raced Happy
+// Eyeballs style (RFC 8305).
+func (h *ProxyHandler) dialUpstream(ctx context.Context, b outboundBinding, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Cfg.Outbound.ConnectTimeout)
+	defer cancel()
+	if b.agent != "" {
+		// The agent resolves the host name itself
+		return h.agents.dial(ctx, b.agent, addr)
+	}
+
+	ips, err := h.lookupUpstream(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := b.dialer()
+	// With a source address only targets of the same family can be reached
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		if local.IP.To4() != nil {
+			network = "tcp4"
+		} else {
+			network = "tcp6"
+		}
+	}
+	ips = orderAddresses(ips, network, config.Cfg.Outbound.IPPreference)
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return raceDial(ctx, dialer, network, ips, port)
+}
+
+// dialUDP connects a UDP socket to addr using the global binding. UDP has no
+// handshake to race, so the first address by IP preference is used.
+func (h *ProxyHandler) dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := h.lookupUpstream(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	b := globalBinding()
+	dialer := b.dialer()
+	network := "udp"
+	if ip := net.ParseIP(b.sourceIP); ip != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		if ip.To4() != nil {
+			network = "udp4"
+		} else {
+			network = "udp6"
+		}
+	}
+	ips = orderAddresses(ips, network, config.Cfg.Outbound.IPPreference)
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// lookupUpstream resolves host with the configured resolver or the net
+// package. IP addresses are returned as is.
+func (h *ProxyHandler) lookupUpstream(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if h.resolver == nil {
+		// The net package reports the lookup to httptrace itself
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return ips, nil
+	}
+
+	// Report the lookup like the net package does for its own resolver
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	ips, err := h.resolver.LookupIP(ctx, host)
+	if trace != nil && trace.DNSDone != nil {
+		addrs := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.IPAddr{IP: ip}
+		}
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+	}
+	return ips, err
+}
+
+// orderAddresses drops the addresses network or preference rule out and
+// interleaves the families, starting with the preferred one (RFC 8305
+// section 4)
+func orderAddresses(ips []net.IP, network, preference string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if strings.HasSuffix(network, "6") || preference == "ipv6-only" {
+		v4 = nil
+	}
+	if strings.HasSuffix(network, "4") || preference == "ipv4-only" {
+		v6 = nil
+	}
+
+	primary, fallback := v6, v4
+	if preference == "prefer-v4" || preference == "ipv4-only" {
+		primary, fallback = v4, v6
+	}
+	ordered := make([]net.IP, 0, len(primary)+len(fallback))
+	for i := 0; i < max(len(primary), len(fallback)); i++ {
+		if i < len(primary) {
+			ordered = append(ordered, primary[i])
+		}
+		if i < len(fallback) {
+			ordered = append(ordered, fallback[i])
+		}
+	}
+	return ordered
+}
+
+// raceDial starts a connection attempt to the next address whenever the
+// previous one failed or has not succeeded within the attempt delay. The
+// first established connection wins, all others are closed.
+func raceDial(ctx context.Context, dialer *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	attempt := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			attemptCtx, cancel := context.WithTimeout(ctx, config.Cfg.Outbound.AttemptTimeout)
+			defer cancel()
+			conn, err := dialer.DialContext(attemptCtx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	attempt()
+	timer := time.NewTimer(config.Cfg.Outbound.AttemptDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Attempts still running are cancelled; close those that
+				// connected anyway
+				go func(n int) {
+					for range n {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(ips) {
+				attempt()
+				timer.Reset(config.Cfg.Outbound.AttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				attempt()
+				timer.Reset(config.Cfg.Outbound.AttemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// dnsTimer measures the name resolution of a request via httptrace
+type dnsTimer struct {
+	start atomic.Int64 // UnixNano
+	took  atomic.Int64 // nanoseconds
+}
+
+// context returns ctx with hooks that record the lookup duration
+func (t *dnsTimer) context(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.start.Store(time.Now().UnixNano())
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			if start := t.start.Load(); start != 0 {
+				t.took.Store(time.Now().UnixNano() - start)
+			}
+		},
+	})
+}
+
+// duration returns the lookup time, 0 if no lookup happened (e.g. a reused
+// connection or an IP address)
+func (t *dnsTimer) duration() time.Duration {
+	return time.Duration(t.took.Load())
+}
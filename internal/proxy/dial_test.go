@@ -0,0 +1,43 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"mlc_goproxy/internal/config"
+	"testing"
+	"time"
+)
+
+func TestValidateOutboundTimeouts(t *testing.T) {
+	saved := config.Cfg.Outbound
+	t.Cleanup(func() { config.Cfg.Outbound = saved })
+
+	tests := []struct {
+		name           string
+		attemptTimeout time.Duration
+		connectTimeout time.Duration
+		wantErr        bool
+	}{
+		{name: "defaults", attemptTimeout: 5 * time.Second, connectTimeout: 10 * time.Second},
+		{name: "attempt_timeout zero", connectTimeout: 10 * time.Second, wantErr: true},
+		{name: "attempt_timeout negative", attemptTimeout: -time.Second, connectTimeout: 10 * time.Second, wantErr: true},
+		{name: "connect_timeout zero", attemptTimeout: 5 * time.Second, wantErr: true},
+		{name: "connect_timeout negative", attemptTimeout: 5 * time.Second, connectTimeout: -time.Second, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Cfg.Outbound = saved
+			config.Cfg.Outbound.Routes = nil
+			config.Cfg.Outbound.ProxyProtocolVersion = 2
+			config.Cfg.Outbound.AttemptTimeout = tc.attemptTimeout
+			config.Cfg.Outbound.ConnectTimeout = tc.connectTimeout
+			if err := validateOutbound(); (err != nil) != tc.wantErr {
+				t.Errorf("validateOutbound() = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
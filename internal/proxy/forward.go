@@ -0,0 +1,232 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/stats"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// forwarder is an opened TCP or UDP port forward
+type forwarder interface {
+	settings() *config.Forward
+	serve(h *ProxyHandler) error
+	close() error
+}
+
+// openForwards validates the configured port forwards and opens their
+// sockets
+func openForwards() ([]forwarder, error) {
+	var forwards []forwarder
+	closeAll := func() {
+		for _, f := range forwards {
+			f.close()
+		}
+	}
+	for _, cfg := range config.Cfg.Forwards {
+		if !cfg.Enabled {
+			continue
+		}
+		var f forwarder
+		err := validateForward(cfg)
+		if err == nil && cfg.Protocol == "udp" {
+			f, err = openUDPForward(cfg)
+		} else if err == nil {
+			f, err = openTCPForward(cfg)
+		}
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("forward %s: %w", cfg.Name, err)
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// validateForward checks the settings shared by TCP and UDP forwards
+func validateForward(cfg config.Forward) error {
+	if cfg.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Target); err != nil {
+		return fmt.Errorf("invalid target %q, expected host:port", cfg.Target)
+	}
+	for _, network := range cfg.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("invalid network %q", network)
+		}
+	}
+	return nil
+}
+
+// forwardNetworks returns the client networks of f, the global ones if f
+// does not restrict them
+func forwardNetworks(f *config.Forward) []string {
+	if len(f.AllowedNetworks) > 0 {
+		return f.AllowedNetworks
+	}
+	return config.Cfg.Security.AllowedNetworks
+}
+
+// tcpForward is an opened TCP config.Forward
+type tcpForward struct {
+	config.Forward
+	ln  net.Listener
+	via *url.URL // nil for direct connections
+}
+
+func openTCPForward(cfg config.Forward) (*tcpForward, error) {
+	f := &tcpForward{Forward: cfg}
+	if cfg.Via != "" {
+		u, err := url.Parse(cfg.Via)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Port() == "" {
+			return nil, fmt.Errorf("invalid via %q, expected http[s]://host:port", cfg.Via)
+		}
+		f.via = u
+	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	f.ln = ln
+	return f, nil
+}
+
+func (f *tcpForward) settings() *config.Forward { return &f.Forward }
+func (f *tcpForward) close() error              { return f.ln.Close() }
+
+// serve accepts connections for f until the listener fails
+func (f *tcpForward) serve(h *ProxyHandler) error {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return err
+		}
+		go h.handleForward(conn, f)
+	}
+}
+
+// handleForward connects one client of f to the target and copies data in
+// both directions until one side closes
+func (h *ProxyHandler) handleForward(conn net.Conn, f *tcpForward) {
+	defer conn.Close()
+
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !h.authManager.IsIPAllowedIn(clientIP, forwardNetworks(&f.Forward)) {
+		log.Printf("Forward %s: connection from %s denied - not in allowed networks", f.Name, clientIP)
+		stats.LogForward(f.Name, clientIP, 0, 0, true)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cfg.Outbound.ConnectTimeout)
+	var targetConn net.Conn
+	var err error
+	if f.via != nil {
+		targetConn, err = h.dialVia(ctx, f.via, f.Target)
+	} else {
+		targetConn, err = h.dialUpstream(ctx, globalBinding(), "tcp", f.Target)
+	}
+	cancel()
+	if err != nil {
+		log.Printf("Forward %s: failed to connect to %s: %v", f.Name, f.Target, err)
+		return
+	}
+	defer targetConn.Close()
+
+	if err := sendProxyHeader(targetConn, conn.RemoteAddr().String(), f.Target); err != nil {
+		log.Printf("Forward %s: failed to send PROXY header to %s: %v", f.Name, f.Target, err)
+		return
+	}
+	log.Printf("Forward %s: %s -> %s", f.Name, clientIP, f.Target)
+	in, out := pipe(conn, targetConn)
+	stats.LogForward(f.Name, clientIP, int64(in), int64(out), false)
+}
+
+// dialVia opens a tunnel to target through the HTTP proxy via using CONNECT
+func (h *ProxyHandler) dialVia(ctx context.Context, via *url.URL, target string) (net.Conn, error) {
+	conn, err := h.dialUpstream(ctx, globalBinding(), "tcp", via.Host)
+	if err != nil {
+		return nil, err
+	}
+	return connectVia(ctx, conn, via, nil, target)
+}
+
+// connectError is a CONNECT request the proxy answered with an error status
+type connectError struct {
+	proxy, target string
+	status        int
+	text          string
+}
+
+func (e *connectError) Error() string {
+	return fmt.Sprintf("proxy %s: CONNECT %s: %s", e.proxy, e.target, e.text)
+}
+
+// connectVia asks the proxy via on conn for a tunnel to target. Connections
+// to https proxies are wrapped in TLS first, using tlsConfig if set. conn is
+// closed on errors.
+func connectVia(ctx context.Context, conn net.Conn, via *url.URL, tlsConfig *tls.Config, target string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if via.Scheme == "https" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = via.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", via.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if via.User != nil {
+		password, _ := via.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(via.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", via.Host, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", via.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &connectError{proxy: via.Host, target: target, status: resp.StatusCode, text: resp.Status}
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The reader may hold bytes the target sent right after the response
+	return &replayConn{Conn: conn, r: reader}, nil
+}
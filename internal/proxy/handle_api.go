@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2025 Michael Lechner
+
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// handleAPI serves the admin API below <stats_path><api_path>/
+func (h *ProxyHandler) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if !h.authManager.CheckAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="MLCProxy Admin"`)
+		http.Error(w, "Admin access denied", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, h.apiPath), "/")
+	resource, name, _ := strings.Cut(path, "/")
+
+	switch resource {
+	case "chaos":
+		h.handleChaosAPI(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleChaosAPI lists the chaos rules (GET) or switches the engine or a
+// single rule on and off (POST ?enabled=true|false)
+func (h *ProxyHandler) handleChaosAPI(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "Parameter enabled=true|false required", http.StatusBadRequest)
+			return
+		}
+		if err := h.chaos.setEnabled(name, enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if name == "" {
+			log.Printf("Chaos engine enabled=%v via admin API from %s", enabled, getClientIP(r))
+		} else {
+			log.Printf("Chaos rule %s enabled=%v via admin API from %s", name, enabled, getClientIP(r))
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, rules := h.chaos.state()
+	writeJSON(w, struct {
+		Enabled bool             `json:"enabled"`
+		Rules   []ChaosRuleState `json:"rules"`
+	}{enabled, rules})
+}
+
+// writeJSON encodes v as JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -8,7 +8,9 @@ See the LICENSE file for further details.
 package proxy
 
 import (
+	"bytes"
 	"fmt"
+	"mlc_goproxy/internal/ca"
 	"mlc_goproxy/internal/config"
 	"mlc_goproxy/internal/stats"
 	"net/http"
@@ -33,6 +35,12 @@ func (h *ProxyHandler) handleStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Admin API
+	if path == h.apiPath || strings.HasPrefix(path, h.apiPath+"/") {
+		h.handleAPI(w, r)
+		return
+	}
+
 	// Remove leading slash and split path to get file extension
 	path = strings.TrimPrefix(path, "/")
 	ext := filepath.Ext(path)
@@ -47,6 +55,15 @@ func (h *ProxyHandler) handleStats(w http.ResponseWriter, r *http.Request) {
 	case ".css":
 		// CSS file
 		http.ServeFile(w, r, filepath.Join(config.Cfg.Paths.StaticDir, "styles.css"))
+	case ".pem", ".crt":
+		// CA certificate download (PEM or DER)
+		handleCADownload(w, ext)
+	case ".pac", ".dat":
+		// Proxy auto-config (proxy.pac, wpad.dat)
+		h.handlePAC(w, r)
+	case ".har":
+		// HAR export of captured traffic
+		h.handleHARExport(w, r)
 	case ".js":
 		// JavaScript file
 		http.ServeFile(w, r, filepath.Join(config.Cfg.Paths.StaticDir, "script.js"))
@@ -91,6 +108,24 @@ func handleStatsAPI(w http.ResponseWriter, r *http.Request) {
 	stats.GetStats().ServeHTTP(w, r)
 }
 
+// handleCADownload serves the interception CA certificate so clients can
+// import it. ".pem" delivers PEM, ".crt" delivers DER.
+func handleCADownload(w http.ResponseWriter, ext string) {
+	format, contentType := "pem", "application/x-pem-file"
+	if ext == ".crt" {
+		format, contentType = "der", "application/x-x509-ca-cert"
+	}
+
+	var buf bytes.Buffer
+	if err := ca.Export(&buf, config.Cfg.Interception.CACert, format); err != nil {
+		http.Error(w, "CA certificate not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=mlcproxy-ca"+ext)
+	w.Write(buf.Bytes())
+}
+
 // handleDevToolsRequest handles Chrome DevTools protocol requests
 func handleDevToolsRequest(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
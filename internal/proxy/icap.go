@@ -0,0 +1,190 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/icap"
+	"mlc_goproxy/internal/stats"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// errICAPBodyTooLarge is returned by bufferICAPBody for bodies above
+// max_body_size
+var errICAPBodyTooLarge = errors.New("body larger than max_body_size")
+
+// icapRequest sends the outgoing request to the REQMOD service. It returns
+// true if the response has been written, either because the service
+// answered in place of the origin or because of the fail-closed policy.
+func (h *ProxyHandler) icapRequest(w http.ResponseWriter, r *http.Request, req *http.Request) bool {
+	service := config.Cfg.ICAP.ReqModURL
+	if h.icap == nil || service == "" || icapBypassed(r) {
+		return false
+	}
+
+	body, err := bufferICAPBody(&req.Body)
+	if errors.Is(err, errICAPBodyTooLarge) {
+		return icapOversize(w, r, err)
+	}
+	if err != nil {
+		return h.icapFailed(w, r, err)
+	}
+	res, err := h.icap.ReqMod(service, req, body)
+	if err != nil {
+		return h.icapFailed(w, r, err)
+	}
+	if res.Unmodified() {
+		return false
+	}
+	if res.Response != nil {
+		writeICAPResponse(w, r, res)
+		return true
+	}
+	if res.Request != nil {
+		applyICAPRequest(req, res)
+	}
+	return false
+}
+
+// icapResponse sends the upstream response to the RESPMOD service. It
+// returns true if the response has been written.
+func (h *ProxyHandler) icapResponse(w http.ResponseWriter, r *http.Request, req *http.Request, resp *http.Response) bool {
+	service := config.Cfg.ICAP.RespModURL
+	if h.icap == nil || service == "" || icapBypassed(r) {
+		return false
+	}
+
+	body, err := bufferICAPBody(&resp.Body)
+	if errors.Is(err, errICAPBodyTooLarge) {
+		return icapOversize(w, r, err)
+	}
+	if err != nil {
+		return h.icapFailed(w, r, err)
+	}
+	res, err := h.icap.RespMod(service, req, resp, body)
+	if err != nil {
+		return h.icapFailed(w, r, err)
+	}
+	if res.Unmodified() || res.Response == nil {
+		return false
+	}
+	writeICAPResponse(w, r, res)
+	return true
+}
+
+// icapFailed applies the fail policy. With "open" the exchange continues
+// unscanned, with "closed" the client gets a 503.
+func (h *ProxyHandler) icapFailed(w http.ResponseWriter, r *http.Request, err error) bool {
+	log.Printf("ICAP scan of %s failed (fail_policy=%s): %v", r.Host, config.Cfg.ICAP.FailPolicy, err)
+	if config.Cfg.ICAP.FailPolicy == "open" {
+		return false
+	}
+	http.Error(w, "Content scanning unavailable", http.StatusServiceUnavailable)
+	stats.LogRequestDetails(r, http.StatusServiceUnavailable, 0, 0, stats.RequestDetails{Source: "icap"})
+	return true
+}
+
+// icapOversize applies the oversize policy to a body too large to be
+// scanned. With "skip" the exchange continues unscanned, with "block" the
+// client gets a 403.
+func icapOversize(w http.ResponseWriter, r *http.Request, err error) bool {
+	if config.Cfg.ICAP.OversizePolicy != "block" {
+		log.Printf("ICAP scan of %s skipped: %v", r.Host, err)
+		return false
+	}
+	log.Printf("Request to %s blocked by ICAP oversize_policy: %v", r.Host, err)
+	http.Error(w, "Content too large to be scanned", http.StatusForbidden)
+	stats.LogRequestDetails(r, http.StatusForbidden, 0, 0, stats.RequestDetails{Source: "icap"})
+	return true
+}
+
+// bufferICAPBody reads *body into memory and puts an equivalent reader back.
+// It returns nil for an empty body.
+func bufferICAPBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	limit := config.Cfg.ICAP.MaxBodySize
+	data, err := io.ReadAll(io.LimitReader(*body, int64(limit)+1))
+	restored := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), *body), *body}
+	*body = restored
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("%w (%d bytes)", errICAPBodyTooLarge, limit)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// applyICAPRequest replaces the outgoing request with the modified one
+func applyICAPRequest(req *http.Request, res *icap.Response) {
+	fields := strings.Fields(res.Request.StartLine)
+	if len(fields) >= 2 {
+		if u, err := url.Parse(fields[1]); err == nil && u.Host != "" {
+			req.Method = fields[0]
+			req.URL = u
+		}
+	}
+	header := res.Request.Header
+	if host := header.Get("Host"); host != "" {
+		req.Host = host
+		header.Del("Host")
+	}
+	header.Del("Content-Length")
+	req.Header = header
+	req.Body = io.NopCloser(bytes.NewReader(res.Body))
+	req.ContentLength = int64(len(res.Body))
+}
+
+// writeICAPResponse sends the HTTP response provided by the ICAP service,
+// e.g. a block page for an infected download. A status outside 200-599
+// cannot be sent as a final response and becomes a 502.
+func writeICAPResponse(w http.ResponseWriter, r *http.Request, res *icap.Response) {
+	status := res.Response.StatusCode()
+	if status < 200 || status > 599 {
+		log.Printf("ICAP service sent invalid status line %q for %s", res.Response.StartLine, r.Host)
+		http.Error(w, "Invalid response from content scanner", http.StatusBadGateway)
+		stats.LogRequestDetails(r, http.StatusBadGateway, 0, 0, stats.RequestDetails{Source: "icap"})
+		return
+	}
+	header := res.Response.Header
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	copyHeader(w.Header(), header)
+	w.Header().Set("Content-Length", strconv.Itoa(len(res.Body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(res.Body)
+	}
+
+	reason := res.Header.Get("X-Infection-Found")
+	if reason == "" {
+		reason = res.Header.Get("X-Violations-Found")
+	}
+	log.Printf("ICAP service answered %s %s with %d %s", r.Method, r.Host, status, reason)
+	stats.LogRequestDetails(r, status, 0, int64(len(res.Body)), stats.RequestDetails{Source: "icap"})
+}
+
+// icapBypassed reports whether the host is excluded from scanning
+func icapBypassed(r *http.Request) bool {
+	return len(config.Cfg.ICAP.BypassHosts) > 0 && matchHostList(config.Cfg.ICAP.BypassHosts, hostname(r.Host))
+}
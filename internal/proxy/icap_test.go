@@ -0,0 +1,159 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/icap"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestICAPFailPolicy(t *testing.T) {
+	// A service address nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := "icap://" + ln.Addr().String() + "/reqmod"
+	ln.Close()
+
+	saved := config.Cfg.ICAP
+	t.Cleanup(func() { config.Cfg.ICAP = saved })
+	config.Cfg.ICAP.ReqModURL = service
+	config.Cfg.ICAP.MaxBodySize = 1024
+
+	tests := []struct {
+		policy      string
+		wantHandled bool
+		wantStatus  int
+	}{
+		{policy: "open", wantHandled: false, wantStatus: http.StatusOK},
+		{policy: "closed", wantHandled: true, wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			config.Cfg.ICAP.FailPolicy = tc.policy
+			h := &ProxyHandler{icap: &icap.Client{Timeout: time.Second, Preview: -1}}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+			w := httptest.NewRecorder()
+			if handled := h.icapRequest(w, r, req); handled != tc.wantHandled {
+				t.Fatalf("handled = %v, want %v", handled, tc.wantHandled)
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestICAPBodyLimit(t *testing.T) {
+	saved := config.Cfg.ICAP
+	t.Cleanup(func() { config.Cfg.ICAP = saved })
+	config.Cfg.ICAP.MaxBodySize = 4
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	req.Body = http.NoBody
+	if body, err := bufferICAPBody(&req.Body); body != nil || err != nil {
+		t.Errorf("empty body: got %q, %v", body, err)
+	}
+
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{body: "abcd"},
+		{body: "abcde", wantErr: true},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(tc.body))
+		_, err := bufferICAPBody(&req.Body)
+		if (err != nil) != tc.wantErr || (err != nil && !errors.Is(err, errICAPBodyTooLarge)) {
+			t.Errorf("body %q: err = %v, want error %v", tc.body, err, tc.wantErr)
+		}
+		// The body must be readable in full afterwards, e.g. for fail-open
+		if rest, _ := io.ReadAll(req.Body); string(rest) != tc.body {
+			t.Errorf("restored body = %q, want %q", rest, tc.body)
+		}
+	}
+}
+
+func TestICAPOversizePolicy(t *testing.T) {
+	saved := config.Cfg.ICAP
+	t.Cleanup(func() { config.Cfg.ICAP = saved })
+	config.Cfg.ICAP.RespModURL = "icap://127.0.0.1:1/respmod" // never contacted
+	config.Cfg.ICAP.MaxBodySize = 4
+	// A scanner outage would block, the oversize policy decides on its own
+	config.Cfg.ICAP.FailPolicy = "closed"
+
+	tests := []struct {
+		policy      string
+		wantHandled bool
+		wantStatus  int
+	}{
+		{policy: "skip", wantHandled: false, wantStatus: http.StatusOK},
+		{policy: "block", wantHandled: true, wantStatus: http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			config.Cfg.ICAP.OversizePolicy = tc.policy
+			h := &ProxyHandler{icap: &icap.Client{Timeout: time.Second, Preview: -1}}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/big.iso", nil)
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("larger than four bytes"))}
+
+			w := httptest.NewRecorder()
+			if handled := h.icapResponse(w, r, r, resp); handled != tc.wantHandled {
+				t.Fatalf("handled = %v, want %v", handled, tc.wantHandled)
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if !tc.wantHandled {
+				if body, _ := io.ReadAll(resp.Body); string(body) != "larger than four bytes" {
+					t.Errorf("unscanned body = %q", body)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteICAPResponseStatus(t *testing.T) {
+	tests := []struct {
+		startLine  string
+		wantStatus int
+	}{
+		{startLine: "HTTP/1.1 403 Forbidden", wantStatus: http.StatusForbidden},
+		{startLine: "HTTP/1.1 200 OK", wantStatus: http.StatusOK},
+		{startLine: "HTTP/1.1 599 Custom", wantStatus: 599},
+		{startLine: "HTTP/1.1 100 Continue", wantStatus: http.StatusBadGateway},
+		{startLine: "HTTP/1.1 42 Odd", wantStatus: http.StatusBadGateway},
+		{startLine: "HTTP/1.1 1000 Odd", wantStatus: http.StatusBadGateway},
+		{startLine: "garbage", wantStatus: http.StatusBadGateway},
+	}
+	for _, tc := range tests {
+		t.Run(tc.startLine, func(t *testing.T) {
+			res := &icap.Response{
+				Header:   http.Header{},
+				Response: &icap.Message{StartLine: tc.startLine, Header: http.Header{}},
+				Body:     []byte("blocked"),
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			w := httptest.NewRecorder()
+			writeICAPResponse(w, r, res)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/stats"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// interceptTLS terminates the client's TLS session with a leaf certificate
+// minted by the local CA and serves the decrypted requests through
+// handleHTTP. The CONNECT response must already have been sent.
+func (h *ProxyHandler) interceptTLS(clientConn net.Conn, r *http.Request, host string) {
+	serverName := hostname(host)
+
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: h.authority.GetCertificate(serverName),
+		NextProtos:     []string{"http/1.1"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("TLS interception handshake with client for %s failed: %v", host, err)
+		return
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	server := &http.Server{
+		// Keep listener and user of the CONNECT request. It was
+		// authenticated there, its credentials stay out of the inner
+		// requests.
+		BaseContext: func(net.Listener) context.Context {
+			ctx := context.WithoutCancel(r.Context())
+			if user := h.authManager.Username(r); user != "" {
+				ctx = context.WithValue(ctx, certUserKey{}, user)
+			}
+			return ctx
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Host == "" {
+				req.Host = host
+			}
+			// Destination ACL and blocklists were checked for the CONNECT
+			// host only, the inner requests must not leave it
+			if hostname(req.Host) != serverName {
+				log.Printf("Intercepted request for %s in tunnel to %s rejected", req.Host, host)
+				http.Error(w, fmt.Sprintf("Misdirected request - this connection is for %s", serverName), http.StatusMisdirectedRequest)
+				stats.LogRequest(req, http.StatusMisdirectedRequest, 0, 0)
+				return
+			}
+			req.URL.Scheme = "https"
+			req.URL.Host = host
+			h.handleHTTP(w, req)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				once.Do(func() { close(done) })
+			}
+		},
+	}
+	go server.Serve(newSingleConnListener(tlsConn))
+	<-done
+	server.Close()
+}
+
+// singleConnListener is a net.Listener that yields exactly one connection
+type singleConnListener struct {
+	mu        sync.Mutex
+	conn      net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	c := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	// Block until closed so http.Server does not spin on errors
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
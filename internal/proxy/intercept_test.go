@@ -0,0 +1,63 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"mlc_goproxy/internal/ca"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInterceptMisdirectedRequest(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if err := ca.Init(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	authority, err := ca.Load(certPath, keyPath, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &ProxyHandler{authManager: &AuthManager{}, authority: authority}
+
+	local, peer := net.Pipe()
+	connect := httptest.NewRequest(http.MethodConnect, "allowed.example:443", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.interceptTLS(local, connect, "allowed.example:443")
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+	conn := tls.Client(peer, &tls.Config{ServerName: "allowed.example", RootCAs: roots})
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The CONNECT host was admitted, another host in the tunnel must not be
+	req, _ := http.NewRequest(http.MethodGet, "https://blocked.example/", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusMisdirectedRequest)
+	}
+	conn.Close()
+	<-done
+}
@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/stats"
+	"net"
+	"net/http"
+	"runtime"
+	"slices"
+)
+
+// proxyListener is an open listener with its configuration
+type proxyListener struct {
+	config.Listener
+	ln net.Listener
+}
+
+type listenerKey struct{}
+
+// listenerOf returns the listener that accepted r, nil for requests that did
+// not come in through a listener
+func listenerOf(r *http.Request) *config.Listener {
+	l, _ := r.Context().Value(listenerKey{}).(*config.Listener)
+	return l
+}
+
+// openListeners binds all enabled listeners. Nothing stays open on error.
+func openListeners() ([]*proxyListener, error) {
+	var listeners []*proxyListener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.ln.Close()
+		}
+	}
+	for _, cfg := range config.Cfg.Listeners {
+		if !cfg.Enabled {
+			continue
+		}
+		if cfg.Port <= 0 || cfg.Port > 65535 {
+			closeAll()
+			return nil, fmt.Errorf("listener %s: invalid port %d", cfg.Name, cfg.Port)
+		}
+		for _, network := range cfg.AllowedNetworks {
+			if _, _, err := net.ParseCIDR(network); err != nil {
+				closeAll()
+				return nil, fmt.Errorf("listener %s: invalid network %q", cfg.Name, network)
+			}
+		}
+		for _, name := range cfg.Routes {
+			if !slices.ContainsFunc(config.Cfg.Outbound.Routes, func(r config.OutboundRoute) bool { return r.Name == name }) {
+				closeAll()
+				return nil, fmt.Errorf("listener %s: unknown outbound route %q", cfg.Name, name)
+			}
+		}
+		if cfg.Agent != "" {
+			if _, ok := config.Cfg.Rendezvous.Tokens[cfg.Agent]; !ok || !config.Cfg.Rendezvous.Enabled {
+				closeAll()
+				return nil, fmt.Errorf("listener %s: agent %s needs an enabled [rendezvous] with token.%s", cfg.Name, cfg.Agent, cfg.Agent)
+			}
+		}
+		if cfg.Auth == "cert" && (cfg.Protocol != "https" || cfg.ClientCA == "") {
+			closeAll()
+			return nil, fmt.Errorf("listener %s: auth = cert requires protocol https and a client_ca", cfg.Name)
+		}
+		var tlsConfig *tls.Config
+		if cfg.Protocol == "https" {
+			var err error
+			if tlsConfig, err = listenerTLSConfig(cfg); err != nil {
+				closeAll()
+				return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+			}
+		}
+		if cfg.ProxyProtocol {
+			if cfg.Protocol == "transparent" || len(cfg.ProxyProtocolFrom) == 0 {
+				closeAll()
+				return nil, fmt.Errorf("listener %s: proxy_protocol requires proxy_protocol_from and is not supported for transparent listeners", cfg.Name)
+			}
+			for _, entry := range cfg.ProxyProtocolFrom {
+				if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+					closeAll()
+					return nil, fmt.Errorf("listener %s: invalid proxy_protocol_from entry %q", cfg.Name, entry)
+				}
+			}
+		}
+		if cfg.Protocol == "transparent" && runtime.GOOS != "linux" {
+			closeAll()
+			return nil, fmt.Errorf("listener %s: transparent proxying is only supported on Linux", cfg.Name)
+		}
+		var lc net.ListenConfig
+		if cfg.Protocol == "transparent" && cfg.TProxy {
+			lc.Control = transparentControl
+		}
+		ln, err := lc.Listen(context.Background(), "tcp", cfg.Addr())
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+		}
+		if cfg.ProxyProtocol {
+			// The header precedes the TLS handshake
+			ln = &proxyProtoListener{Listener: ln, trusted: cfg.ProxyProtocolFrom}
+		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		listeners = append(listeners, &proxyListener{Listener: cfg, ln: ln})
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listener enabled")
+	}
+	return listeners, nil
+}
+
+// serve handles the connections of l until the listener fails
+func (l *proxyListener) serve(h *ProxyHandler) error {
+	if l.Protocol == "transparent" {
+		return l.serveTransparent(h)
+	}
+	server := &http.Server{
+		Handler: h,
+		BaseContext: func(net.Listener) context.Context {
+			ctx := context.WithValue(context.Background(), listenerKey{}, &l.Listener)
+			return stats.WithListener(ctx, l.Name)
+		},
+	}
+	return server.Serve(l.ln)
+}
+
+// allowedNetworks returns the client networks that may use the listener of r
+func allowedNetworks(r *http.Request) []string {
+	return allowedNetworksOf(listenerOf(r))
+}
+
+// allowedNetworksOf returns the client networks of l, the global ones if l
+// does not restrict them
+func allowedNetworksOf(l *config.Listener) []string {
+	if l != nil && len(l.AllowedNetworks) > 0 {
+		return l.AllowedNetworks
+	}
+	return config.Cfg.Security.AllowedNetworks
+}
+
+// routeEnabled reports whether the outbound route name applies to r
+func routeEnabled(r *http.Request, name string) bool {
+	l := listenerOf(r)
+	return l == nil || len(l.Routes) == 0 || slices.Contains(l.Routes, name)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/stats"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// mockRule is a compiled config.MockRule
+type mockRule struct {
+	config.MockRule
+	headerPatterns map[string]*regexp.Regexp
+	tmpl           *template.Template // inline body template, nil if not templated
+}
+
+// mockTemplateData is available inside body templates, e.g. {{.Query "id"}}
+type mockTemplateData struct {
+	Method string
+	Host   string
+	Path   string
+	Now    time.Time
+	req    *http.Request
+}
+
+// Header returns a request header value
+func (d mockTemplateData) Header(name string) string {
+	return d.req.Header.Get(name)
+}
+
+// Query returns a query parameter
+func (d mockTemplateData) Query(name string) string {
+	return d.req.URL.Query().Get(name)
+}
+
+// compileMockRules validates the configured mock rules
+func compileMockRules(rules []config.MockRule) ([]*mockRule, error) {
+	var compiled []*mockRule
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		// 1xx are no final responses, the client would wait for one
+		if r.Status < 200 || r.Status > 599 {
+			return nil, fmt.Errorf("mock rule %s: invalid status %d, expected 200-599", r.Name, r.Status)
+		}
+		m := &mockRule{MockRule: r, headerPatterns: make(map[string]*regexp.Regexp)}
+		for name, expr := range r.MatchHeaders {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("mock rule %s: header %s: %w", r.Name, name, err)
+			}
+			m.headerPatterns[name] = re
+		}
+		if r.Template && r.BodyFile == "" {
+			tmpl, err := template.New(r.Name).Parse(r.Body)
+			if err != nil {
+				return nil, fmt.Errorf("mock rule %s: %w", r.Name, err)
+			}
+			m.tmpl = tmpl
+		}
+		compiled = append(compiled, m)
+	}
+	return compiled, nil
+}
+
+// matches checks host, method, path and header conditions
+func (m *mockRule) matches(r *http.Request) bool {
+	if len(m.Methods) > 0 && !slices.Contains(m.Methods, r.Method) {
+		return false
+	}
+	if m.Path != "" && r.URL.Path != m.Path {
+		return false
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, m.PathPrefix) {
+		return false
+	}
+	for name, re := range m.headerPatterns {
+		if !re.MatchString(r.Header.Get(name)) {
+			return false
+		}
+	}
+	if len(m.Hosts) == 0 {
+		return true
+	}
+	return matchHostList(m.Hosts, hostname(r.Host))
+}
+
+// body renders the response body for r
+func (m *mockRule) body(r *http.Request) ([]byte, error) {
+	tmpl := m.tmpl
+	if m.BodyFile != "" {
+		// Read the file on every request so it can be edited while running
+		data, err := os.ReadFile(m.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		if !m.Template {
+			return data, nil
+		}
+		if tmpl, err = template.New(m.Name).Parse(string(data)); err != nil {
+			return nil, err
+		}
+	}
+	if tmpl == nil {
+		return []byte(m.Body), nil
+	}
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, mockTemplateData{
+		Method: r.Method,
+		Host:   r.Host,
+		Path:   r.URL.Path,
+		Now:    time.Now(),
+		req:    r,
+	})
+	return buf.Bytes(), err
+}
+
+// serveMock answers r with the first matching mock rule. It returns false if
+// no rule matches and the request should be forwarded.
+func (h *ProxyHandler) serveMock(w http.ResponseWriter, r *http.Request) bool {
+	for _, m := range h.mocks {
+		if !m.matches(r) {
+			continue
+		}
+
+		body, err := m.body(r)
+		if err != nil {
+			log.Printf("Mock rule %s failed: %v", m.Name, err)
+			http.Error(w, "Mock rule "+m.Name+" failed: "+err.Error(), http.StatusInternalServerError)
+			stats.LogRequestDetails(r, http.StatusInternalServerError, 0, 0, stats.RequestDetails{Source: "mock"})
+			return true
+		}
+
+		for name, value := range m.ResponseHeaders {
+			w.Header().Set(name, value)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("X-MLCProxy-Mock", m.Name)
+		w.WriteHeader(m.Status)
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+		log.Printf("Mock rule %s answered %s %s%s", m.Name, r.Method, r.Host, r.URL.Path)
+		stats.LogRequestDetails(r, m.Status, 0, int64(len(body)), stats.RequestDetails{Source: "mock"})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"mlc_goproxy/internal/config"
+	"testing"
+)
+
+func TestCompileMockRulesStatus(t *testing.T) {
+	tests := []struct {
+		status  int
+		enabled bool
+		wantErr bool
+	}{
+		{status: 200, enabled: true},
+		{status: 204, enabled: true},
+		{status: 599, enabled: true},
+		{status: 0, enabled: true, wantErr: true},
+		{status: 100, enabled: true, wantErr: true},
+		{status: 199, enabled: true, wantErr: true},
+		{status: 600, enabled: true, wantErr: true},
+		{status: 999, enabled: true, wantErr: true},
+		{status: -1, enabled: true, wantErr: true},
+		{status: 0, enabled: false}, // disabled rules are not compiled
+	}
+	for _, tc := range tests {
+		rule := config.MockRule{Name: "test", Enabled: tc.enabled, Status: tc.status}
+		_, err := compileMockRules([]config.MockRule{rule})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("status %d (enabled %v): err = %v, want error %v", tc.status, tc.enabled, err, tc.wantErr)
+		}
+	}
+}
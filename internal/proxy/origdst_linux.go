@@ -0,0 +1,86 @@
+//go:build linux
+
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Socket options missing in the syscall package
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST (IPv4) and IP6T_SO_ORIGINAL_DST (IPv6)
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+// originalDst returns the destination of a connection redirected by
+// iptables REDIRECT/DNAT (SO_ORIGINAL_DST)
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := tcp.LocalAddr().(*net.TCPAddr)
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// The kernel fills a sockaddr_in or sockaddr_in6; the syscall
+		// package has no getter for those, so structs of matching size are
+		// used instead
+		if local != nil && local.IP.To4() != nil {
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			sa := mreq.Multiaddr // struct sockaddr_in
+			addr = &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(sa[2])<<8 | int(sa[3])}
+			return
+		}
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		sa := info.Addr // struct sockaddr_in6, port in network byte order
+		port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, sa.Port))
+		addr = &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: int(port)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return addr, nil
+}
+
+// transparentControl sets IP_TRANSPARENT on a listening socket, so it
+// accepts connections diverted by an iptables TPROXY rule
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		if sockErr == nil && network != "tcp4" {
+			// Fails on IPv4-only sockets
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
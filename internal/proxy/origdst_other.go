@@ -0,0 +1,25 @@
+//go:build !linux
+
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// originalDst is only available on Linux
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("transparent proxying is only supported on Linux")
+}
+
+// transparentControl is only available on Linux
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("transparent proxying is only supported on Linux")
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"mlc_goproxy/internal/config"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// isPACRequest reports whether r asks the proxy itself for its proxy
+// auto-config file, as browsers do with WPAD or a configured PAC URL
+func isPACRequest(r *http.Request) bool {
+	if r.URL.Host != "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	return r.URL.Path == "/proxy.pac" || r.URL.Path == "/wpad.dat"
+}
+
+// handlePAC serves the proxy auto-config file for the listener the request
+// came in on or the one named by ?listener=
+func (h *ProxyHandler) handlePAC(w http.ResponseWriter, r *http.Request) {
+	l := pacListener(r)
+	if l == nil {
+		http.Error(w, "No proxy listener for auto-config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Cache-Control", "max-age=300")
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprint(w, h.pacScript(l, pacProxyHost(r, l)))
+}
+
+// pacListener selects the listener the PAC file points to. Transparent
+// listeners cannot be configured in a browser.
+func pacListener(r *http.Request) *config.Listener {
+	if name := r.URL.Query().Get("listener"); name != "" {
+		for i, l := range config.Cfg.Listeners {
+			if l.Name == name && l.Enabled && l.Protocol != "transparent" {
+				return &config.Cfg.Listeners[i]
+			}
+		}
+		return nil
+	}
+	if l := listenerOf(r); l != nil && l.Protocol != "transparent" {
+		return l
+	}
+	for i, l := range config.Cfg.Listeners {
+		if l.Enabled && l.Protocol != "transparent" {
+			return &config.Cfg.Listeners[i]
+		}
+	}
+	return nil
+}
+
+// pacProxyHost returns the address browsers use to reach the proxy: the
+// listener's bind address, the host the PAC file was fetched from or the
+// local address of the connection
+func pacProxyHost(r *http.Request, l *config.Listener) string {
+	if ip, err := netip.ParseAddr(l.Bind); err == nil && !ip.IsUnspecified() {
+		return l.Bind
+	}
+	if host := hostname(r.Host); r.URL.Host == "" && host != "" && host != config.Cfg.Features.StatsHost {
+		return host
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+	}
+	return "127.0.0.1"
+}
+
+// pacScript generates FindProxyForURL for listener l reachable at host.
+// Plain host names, the stats host, published reverse proxy sites and the
+// configured direct hosts and networks bypass the proxy.
+func (h *ProxyHandler) pacScript(l *config.Listener, host string) string {
+	hosts := []string{h.statsHost}
+	for _, site := range config.Cfg.Reverse.Sites {
+		if site.Enabled {
+			hosts = append(hosts, site.Hosts...)
+		}
+	}
+	hosts = append(hosts, config.Cfg.PAC.DirectHosts...)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Proxy auto-config for MLCProxy listener %s\n", l.Name)
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	b.WriteString("\tif (isPlainHostName(host)) return \"DIRECT\";\n")
+	seen := make(map[string]bool)
+	for _, pattern := range hosts {
+		if cond := pacHostCondition(pattern); cond != "" && !seen[cond] {
+			seen[cond] = true
+			fmt.Fprintf(&b, "\tif (%s) return \"DIRECT\";\n", cond)
+		}
+	}
+	var networks []string
+	for _, network := range config.Cfg.PAC.DirectNetworks {
+		if cond := pacNetCondition(network); cond != "" {
+			networks = append(networks, cond)
+		}
+	}
+	if len(networks) > 0 {
+		b.WriteString("\tvar ip = dnsResolve(host);\n")
+		fmt.Fprintf(&b, "\tif (ip && (%s)) return \"DIRECT\";\n", strings.Join(networks, " ||\n\t\t"))
+	}
+
+	keyword := "PROXY"
+	if l.Protocol == "https" {
+		keyword = "HTTPS"
+	}
+	proxy := keyword + " " + net.JoinHostPort(host, strconv.Itoa(l.Port))
+	fmt.Fprintf(&b, "\treturn %q;\n}\n", proxy)
+	return b.String()
+}
+
+// pacHostCondition translates a host pattern (see matchHostPattern) to a
+// PAC expression
+func pacHostCondition(pattern string) string {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	switch {
+	case pattern == "":
+		return ""
+	case pattern == "*":
+		return "true"
+	case strings.HasPrefix(pattern, "*.") || strings.HasPrefix(pattern, "."):
+		domain := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+		return fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", domain, "."+domain)
+	}
+	return fmt.Sprintf("host == %q", pattern)
+}
+
+// pacNetCondition translates an IPv4 address or CIDR network to an isInNet
+// expression. isInNet does not support IPv6, so those are skipped.
+func pacNetCondition(network string) string {
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil {
+		ip, err := netip.ParseAddr(network)
+		if err != nil {
+			return ""
+		}
+		prefix = netip.PrefixFrom(ip, ip.BitLen())
+	}
+	if !prefix.Addr().Is4() {
+		return ""
+	}
+	mask := net.CIDRMask(prefix.Bits(), 32)
+	return fmt.Sprintf("isInNet(ip, %q, %q)", prefix.Masked().Addr(), net.IP(mask).String())
+}
@@ -8,19 +8,36 @@ See the LICENSE file for further details.
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mlc_goproxy/internal/blocklist"
+	"mlc_goproxy/internal/ca"
+	"mlc_goproxy/internal/capture"
+	"mlc_goproxy/internal/cassette"
 	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/dnsserver"
+	"mlc_goproxy/internal/icap"
+	"mlc_goproxy/internal/resolver"
 	"mlc_goproxy/internal/stats"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
-// getClientIP extracts the client's IP address from the request
+// getClientIP extracts the client's IP address from the request. On
+// listeners with PROXY protocol the address from the header is used, a
+// X-Forwarded-For sent by the client is not trusted there.
 func getClientIP(r *http.Request) string {
+	if l := listenerOf(r); l != nil && l.ProxyProtocol {
+		return remoteIP(r)
+	}
+
 	// Check X-Forwarded-For header first
 	forwardedFor := r.Header.Get("X-Forwarded-For")
 	if forwardedFor != "" {
@@ -28,8 +45,12 @@ func getClientIP(r *http.Request) string {
 		ips := strings.Split(forwardedFor, ",")
 		return strings.TrimSpace(ips[0])
 	}
+	return remoteIP(r)
+}
 
-	// Fallback to RemoteAddr
+// remoteIP returns the IP address of the connection r came in on, recovered
+// from the PROXY header if there was one
+func remoteIP(r *http.Request) string {
 	remoteAddr := r.RemoteAddr
 
 	// Handle IPv4 with port
@@ -53,6 +74,44 @@ func getClientIP(r *http.Request) string {
 	return remoteAddr
 }
 
+// hostname returns the lower-case host of a "host:port" value without port
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		hostport = host
+	}
+	return strings.ToLower(strings.Trim(hostport, "[]"))
+}
+
+// closeWrite half-closes conn if it supports it (TCP and TLS connections)
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// copyHalf copies src to dst, half-closes dst when src is exhausted and
+// signals done
+func copyHalf(dst net.Conn, src io.Reader, done chan<- bool) {
+	io.Copy(dst, src)
+	closeWrite(dst)
+	done <- true
+}
+
+// pipe connects client and target in both directions until one side
+// finishes and returns the bytes read from each
+func pipe(client, target net.Conn) (clientBytes, targetBytes uint64) {
+	clientReader := NewTrackingReader(client)
+	targetReader := NewTrackingReader(target)
+
+	done := make(chan bool, 2)
+	go copyHalf(client, targetReader, done)
+	go copyHalf(target, clientReader, done)
+
+	// Wait for either direction to finish
+	<-done
+	return clientReader.BytesRead(), targetReader.BytesRead()
+}
+
 // copyHeader copies HTTP headers from src to dst
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
@@ -62,8 +121,38 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-// Start initializes and starts the proxy server
-func Start(addr string) error {
+// hopHeaders apply to a single connection and are not forwarded
+// (RFC 9110, section 7.6.1). Proxy-Authorization carries the client's
+// credentials for this proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including those
+// named in the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// Start initializes the proxy and serves all enabled listeners
+func Start() error {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	handler := &ProxyHandler{
@@ -84,15 +173,182 @@ func Start(addr string) error {
 	log.Printf("- Allowed networks: %v", config.Cfg.Security.AllowedNetworks)
 	log.Printf("- Stats host %s is always allowed", handler.statsHost)
 
-	server := &http.Server{
-		Addr:    addr,
-		Handler: handler,
+	if config.Cfg.Interception.Enabled {
+		authority, err := ca.Load(config.Cfg.Interception.CACert, config.Cfg.Interception.CAKey, config.Cfg.Interception.LeafValidity)
+		if err != nil {
+			return fmt.Errorf("TLS interception enabled but CA could not be loaded (run 'mlcproxy ca init'): %w", err)
+		}
+		handler.authority = authority
+		log.Printf("- TLS interception enabled (CA: %s)", authority.Certificate().Subject.CommonName)
+	}
+
+	if config.Cfg.Capture.Enabled {
+		handler.recorder = capture.NewRecorder(config.Cfg.Capture.MaxEntries, config.Cfg.Capture.MaxBodySize)
+		log.Printf("- Capture enabled (clients: %v, hosts: %v), HAR export at %s/capture.har",
+			config.Cfg.Capture.Clients, config.Cfg.Capture.Hosts, handler.statsPath)
+	}
+
+	if config.Cfg.Replay.Mode != cassette.ModeOff {
+		store, err := cassette.NewStore(config.Cfg.Replay.CassetteDir, config.Cfg.Replay.MatchHeaders)
+		if err != nil {
+			return fmt.Errorf("cassette directory %s: %w", config.Cfg.Replay.CassetteDir, err)
+		}
+		handler.cassettes = store
+		log.Printf("- Replay mode %s (cassettes: %s)", config.Cfg.Replay.Mode, config.Cfg.Replay.CassetteDir)
+	}
+
+	if err := validateOutbound(); err != nil {
+		return err
+	}
+	if config.Cfg.Outbound.SourceIP != "" || config.Cfg.Outbound.Interface != "" || len(config.Cfg.Outbound.Routes) > 0 {
+		log.Printf("- Outbound binding: source_ip=%q interface=%q, %d routes",
+			config.Cfg.Outbound.SourceIP, config.Cfg.Outbound.Interface, len(config.Cfg.Outbound.Routes))
+	}
+
+	mocks, err := compileMockRules(config.Cfg.Mock.Rules)
+	if err != nil {
+		return err
+	}
+	handler.mocks = mocks
+	if len(mocks) > 0 {
+		log.Printf("- %d mock rules active", len(mocks))
+	}
+
+	rewrites, err := compileRewriteRules(config.Cfg.Rewrite.Rules)
+	if err != nil {
+		return err
+	}
+	handler.rewrites = rewrites
+	if len(rewrites) > 0 {
+		log.Printf("- %d rewrite rules active", len(rewrites))
+	}
+
+	sites, err := compileReverseSites(config.Cfg.Reverse.Sites)
+	if err != nil {
+		return err
+	}
+	handler.reverse = sites
+	for _, site := range sites {
+		handler.watchHealth(site)
+		log.Printf("- Reverse proxy site %s: %v%s -> %v", site.Name, site.Hosts, site.PathPrefix, site.Backends)
+	}
+
+	filters, err := compileFilterRules(config.Cfg.Filter.Rules)
+	if err != nil {
+		return err
+	}
+	handler.filters = filters
+	if len(filters) > 0 {
+		log.Printf("- %d body filter rules active", len(filters))
+	}
+
+	if config.Cfg.ICAP.Enabled {
+		handler.icap = &icap.Client{Timeout: config.Cfg.ICAP.Timeout, Preview: config.Cfg.ICAP.Preview}
+		log.Printf("- ICAP enabled (reqmod: %q, respmod: %q, fail_policy: %s, oversize_policy: %s)",
+			config.Cfg.ICAP.ReqModURL, config.Cfg.ICAP.RespModURL, config.Cfg.ICAP.FailPolicy, config.Cfg.ICAP.OversizePolicy)
+	}
+
+	// The DNS server forwards to the resolver's upstreams even if outbound
+	// connections use the system resolver
+	var res *resolver.Resolver
+	if config.Cfg.Resolver.Enabled || config.Cfg.DNS.Enabled {
+		res, err = resolver.New(resolver.Options{
+			Servers:       config.Cfg.Resolver.Servers,
+			DomainServers: config.Cfg.Resolver.DomainServers,
+			Hosts:         config.Cfg.Resolver.Hosts,
+			Timeout:       config.Cfg.Resolver.Timeout,
+			CacheTTL:      config.Cfg.Resolver.CacheTTL,
+			MaxTTL:        config.Cfg.Resolver.MaxTTL,
+			CAFile:        config.Cfg.Resolver.CAFile,
+		})
+		if err != nil {
+			return fmt.Errorf("resolver: %w", err)
+		}
+	}
+	if config.Cfg.Resolver.Enabled {
+		handler.resolver = res
+		log.Printf("- Custom resolver enabled (servers: %v, %d domain routes, %d static hosts)",
+			config.Cfg.Resolver.Servers, len(config.Cfg.Resolver.DomainServers), len(config.Cfg.Resolver.Hosts))
+	}
+
+	if len(config.Cfg.Blocklist.Lists) > 0 {
+		lists, err := blocklist.New(config.Cfg.Blocklist.Lists, config.Cfg.Blocklist.ExemptClients)
+		if err != nil {
+			return err
+		}
+		lists.Watch(config.Cfg.Blocklist.ReloadInterval)
+		handler.blocklists = lists
+		log.Printf("- Blocklists loaded: %d domains %v", lists.Len(), lists.Sizes())
+	}
+
+	if config.Cfg.DNS.Enabled {
+		dnsServer := &dnsserver.Server{
+			Resolver:      res,
+			Blocklists:    handler.blocklists,
+			BlockedAnswer: config.Cfg.DNS.BlockedAnswer,
+			Allow:         handler.authManager.IsIPAllowed,
+		}
+		if err := dnsServer.Start(config.Cfg.DNS.Listen); err != nil {
+			return fmt.Errorf("DNS server: %w", err)
+		}
+		log.Printf("- DNS server listening on %s (UDP/TCP)", config.Cfg.DNS.Listen)
+	}
+
+	if handler.chaos, err = newChaosEngine(config.Cfg.Chaos.Enabled, config.Cfg.Chaos.Rules); err != nil {
+		return err
+	}
+	if len(config.Cfg.Chaos.Rules) > 0 {
+		log.Printf("- %d chaos rules loaded (active: %v), toggle via %s%s/chaos",
+			len(config.Cfg.Chaos.Rules), config.Cfg.Chaos.Enabled, handler.statsPath, handler.apiPath)
+	}
+
+	if config.Cfg.Rendezvous.Enabled {
+		if err := handler.startRendezvous(); err != nil {
+			return fmt.Errorf("rendezvous: %w", err)
+		}
+		log.Printf("- Rendezvous for %d agents listening on %s", len(config.Cfg.Rendezvous.Tokens), config.Cfg.Rendezvous.Listen)
+	}
+	if config.Cfg.Agent.Enabled {
+		if err := handler.startAgent(); err != nil {
+			return fmt.Errorf("agent: %w", err)
+		}
+		log.Printf("- Agent %s connecting to rendezvous %s", config.Cfg.Agent.Name, config.Cfg.Agent.Server)
+	}
+
+	listeners, err := openListeners()
+	if err != nil {
+		return err
+	}
+	forwards, err := openForwards()
+	if err != nil {
+		for _, l := range listeners {
+			l.ln.Close()
+		}
+		return err
+	}
+	errs := make(chan error, len(listeners)+len(forwards))
+	for _, l := range listeners {
+		log.Printf("Starting proxy listener %s on %s (auth: %s, allowed networks: %v, routes: %v)",
+			l.Name, l.Addr(), l.Auth, allowedNetworksOf(&l.Listener), l.Routes)
+		go func() {
+			errs <- fmt.Errorf("listener %s: %w", l.Name, l.serve(handler))
+		}()
+	}
+	for _, f := range forwards {
+		cfg := f.settings()
+		via := "direct"
+		if u, err := url.Parse(cfg.Via); err == nil && cfg.Via != "" {
+			via = "via " + u.Redacted()
+		}
+		log.Printf("Starting %s forward %s on %s -> %s (%s)", cfg.Protocol, cfg.Name, cfg.Listen, cfg.Target, via)
+		go func() {
+			errs <- fmt.Errorf("forward %s: %w", cfg.Name, f.serve(handler))
+		}()
 	}
 
-	log.Printf("Starting proxy server on %s", addr)
 	log.Printf("Statistics available at http://%s%s", handler.statsHost, handler.statsPath)
-	log.Printf("Configure your browser to use http://%s as proxy", addr)
-	return server.ListenAndServe()
+	log.Printf("Configure your browser to use http://%s as proxy", listeners[0].Addr())
+	return <-errs
 }
 
 // ProxyHandler handles proxy requests and implements http.Handler
@@ -101,6 +357,27 @@ type ProxyHandler struct {
 	apiPath     string
 	statsHost   string
 	authManager *AuthManager
+	authority   *ca.Authority     // nil unless TLS interception is enabled
+	recorder    *capture.Recorder // nil unless capture is enabled
+	cassettes   *cassette.Store   // nil unless a replay mode is active
+	chaos       *chaosEngine
+	mocks       []*mockRule
+	rewrites    []*rewriteRule
+	filters     []*filterRule
+	icap        *icap.Client       // nil unless ICAP is enabled
+	agents      *rendezvous        // nil unless the rendezvous is enabled
+	blocklists  *blocklist.Manager // nil unless blocklists are configured
+	resolver    *resolver.Resolver // nil unless the custom resolver is enabled
+	transports  sync.Map           // outboundBinding -> *http.Transport
+	reverse     []*reverseSite
+}
+
+// denyBlocked rejects a request whose host is on a blocklist
+func (h *ProxyHandler) denyBlocked(w http.ResponseWriter, r *http.Request, list string) {
+	log.Printf("Request to %s blocked by list %s for IP %s", r.Host, list, getClientIP(r))
+	http.Error(w, fmt.Sprintf("Access denied - %s is on blocklist %s", hostname(r.Host), list), http.StatusForbidden)
+	stats.LogBlocked(list)
+	stats.LogRequestDetails(r, http.StatusForbidden, 0, 0, stats.RequestDetails{Source: "blocklist"})
 }
 
 // ServeHTTP handles all incoming HTTP requests
@@ -110,8 +387,15 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if strings.Contains(host, ":") {
 		host = strings.Split(host, ":")[0]
 	}
+	// Published backends take precedence over the internal endpoints
+	if site := h.matchReverse(r); site != nil {
+		h.handleReverse(w, r, site)
+		return
+	}
+
 	// Check if this is a stats request (either via stats.local or /stats or /stat path)
-	if host == h.statsHost || strings.HasPrefix(r.URL.Path, "/stats") || strings.HasPrefix(r.URL.Path, "/stat/") || r.URL.Path == "/stat" {
+	// or a browser fetching the proxy auto-config from the proxy itself
+	if host == h.statsHost || strings.HasPrefix(r.URL.Path, "/stats") || strings.HasPrefix(r.URL.Path, "/stat/") || r.URL.Path == "/stat" || isPACRequest(r) {
 		// Check for recursion
 		if r.Header.Get("X-MLCProxy-Internal") == "true" {
 			http.Error(w, "Loop detected", http.StatusInternalServerError)
@@ -134,37 +418,67 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !h.admit(w, r) {
+		return
+	}
+
+	// Log all other requests
+	log.Printf("Proxy request: %s %s %s from IP %s", r.Method, r.Host, r.URL.String(), getClientIP(r))
+
+	// Handle HTTPS CONNECT requests
+	if r.Method == http.MethodConnect {
+		h.handleHTTPS(w, r)
+		return
+	}
+
+	// Handle standard HTTP proxy requests
+	h.handleHTTP(w, r)
+}
+
+// admit runs the access checks for r: client network, authentication,
+// destination ACLs and blocklists. Denied requests are answered on w.
+func (h *ProxyHandler) admit(w http.ResponseWriter, r *http.Request) bool {
 	// Extract client IP
 	clientIP := getClientIP(r)
 
 	// Verify client IP
-	if !h.authManager.IsIPAllowed(clientIP) {
+	networks := allowedNetworks(r)
+	if !h.authManager.IsIPAllowedIn(clientIP, networks) {
 		log.Printf("Access denied for IP %s - not in allowed networks (%v)",
-			clientIP, config.Cfg.Security.AllowedNetworks)
-		http.Error(w, fmt.Sprintf("Access denied - IP %s not in allowed networks (%s)", clientIP, strings.Join(config.Cfg.Security.AllowedNetworks, ", ")), http.StatusForbidden)
+			clientIP, networks)
+		http.Error(w, fmt.Sprintf("Access denied - IP %s not in allowed networks (%s)", clientIP, strings.Join(networks, ", ")), http.StatusForbidden)
 		stats.LogRequest(r, http.StatusForbidden, 0, 0)
-		return
+		return false
 	}
 
 	// Check auth if enabled
-	if config.Cfg.Auth.EnableAuth && !h.authManager.CheckAuth(r) {
+	if !h.authManager.CheckAuth(r) {
 		log.Printf("Auth failed for IP %s", clientIP)
+		if l := listenerOf(r); l != nil && l.Auth == "cert" {
+			// Basic credentials would not help
+			http.Error(w, "Access denied - client certificate not authorized", http.StatusForbidden)
+			stats.LogRequest(r, http.StatusForbidden, 0, 0)
+			return false
+		}
 		h.authManager.RequireAuth(w)
 		stats.LogRequest(r, http.StatusProxyAuthRequired, 0, 0)
-		return
+		return false
 	}
 
-	// Log all other requests
-	log.Printf("Proxy request: %s %s %s from IP %s", r.Method, r.Host, r.URL.String(), clientIP)
-
-	// Handle HTTPS CONNECT requests
-	if r.Method == http.MethodConnect {
-		h.handleHTTPS(w, r)
-		return
+	// Check destination ACLs
+	if !h.authManager.IsDestinationAllowed(r.Host) {
+		log.Printf("Destination %s denied for IP %s", r.Host, clientIP)
+		http.Error(w, fmt.Sprintf("Access denied - destination %s is not allowed", r.Host), http.StatusForbidden)
+		stats.LogRequest(r, http.StatusForbidden, 0, 0)
+		return false
 	}
 
-	// Handle standard HTTP proxy requests
-	h.handleHTTP(w, r)
+	// Check the domain blocklists
+	if list := h.blocklists.Match(clientIP, hostname(r.Host)); list != "" {
+		h.denyBlocked(w, r, list)
+		return false
+	}
+	return true
 }
 
 // handleHTTP handles standard HTTP proxy requests
@@ -175,12 +489,29 @@ func (h *ProxyHandler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		stats.LogRequest(r, http.StatusOK, 2, 2)
 		return
 	}
+
+	// Answer stubbed endpoints without contacting the origin
+	if h.serveMock(w, r) {
+		return
+	}
+
+	// Apply fault injection rules
+	fault := h.chaos.match(r)
+	fault.delay()
+	if status := fault.status(); status != 0 {
+		logChaos(fault, r, fmt.Sprintf("synthetic status %d", status))
+		http.Error(w, http.StatusText(status)+" (injected by MLCProxy)", status)
+		stats.LogRequestDetails(r, status, 0, 0, stats.RequestDetails{Source: "chaos"})
+		return
+	}
+
 	// Track request body size
 	var requestReader *TrackingReader
 	if r.Body != nil {
 		requestReader = NewTrackingReader(r.Body)
 		r.Body = io.NopCloser(requestReader)
 	}
+	rec := h.startCapture(r)
 
 	// Ensure complete URL
 	targetURL := r.URL.String()
@@ -189,7 +520,7 @@ func (h *ProxyHandler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create and send request
-	client := &http.Client{}
+	client := &http.Client{Transport: h.transportFor(h.outboundFor(r))}
 	req, err := http.NewRequest(r.Method, targetURL, r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -198,6 +529,32 @@ func (h *ProxyHandler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	copyHeader(req.Header, r.Header)
+	removeHopHeaders(req.Header)
+	rewrites := h.matchRewrites(r)
+	rewrites.request(req)
+	reverse := reverseTargetOf(r)
+	if reverse != nil {
+		// Redirects of the backend go to the client, mapped to the public URL
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	reverse.request(req, r)
+
+	// Let the ICAP service inspect the request
+	if h.icapRequest(w, r, req) {
+		return
+	}
+	req = rec.traceRequest(req)
+	dns := &dnsTimer{}
+	req = req.WithContext(dns.context(req.Context()))
+
+	// Serve recorded responses in replay mode
+	if h.replayFromCassette(w, r, req) {
+		return
+	}
+	tape := h.startRecording(req)
+
 	resp, err := client.Do(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -206,20 +563,51 @@ func (h *ProxyHandler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
+	rewrites.response(resp.Header)
+	reverse.response(resp.Header)
+
+	// Let the ICAP service inspect the response
+	if h.icapResponse(w, r, req, resp) {
+		return
+	}
+
+	// Apply the body filter pipeline
+	if status, reason := h.filterResponse(r, resp); status != 0 {
+		log.Printf("Response from %s blocked: %s", r.Host, reason)
+		http.Error(w, reason, status)
+		stats.LogRequestDetails(r, status, 0, 0, stats.RequestDetails{Source: "filter"})
+		return
+	}
+
 	copyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 	// Track response body size
-	responseReader := NewTrackingReader(resp.Body)
+	responseReader := NewTrackingReader(fault.wrap(tape.teeResponse(rec.teeResponse(resp.Body))))
 	_, err = io.Copy(w, responseReader)
 	if err != nil {
 		log.Printf("Error copying response: %v", err)
 	}
+	tape.save(h.cassettes, resp, err)
 
 	var requestBytes int64
 	if requestReader != nil {
 		requestBytes = int64(requestReader.BytesRead())
 	}
-	stats.LogRequest(r, resp.StatusCode, requestBytes, int64(responseReader.BytesRead()))
+	rec.finish(h.recorder, req, resp, requestBytes, int64(responseReader.BytesRead()))
+	stats.LogRequestDetails(r, resp.StatusCode, requestBytes, int64(responseReader.BytesRead()), stats.RequestDetails{DNS: dns.duration()})
+
+	// Cut the connection mid-body if a chaos rule or the size limit asked for it
+	if errors.Is(err, errChaosDrop) || errors.Is(err, errResponseTooLarge) {
+		if errors.Is(err, errChaosDrop) {
+			logChaos(fault, r, "connection dropped")
+		} else {
+			log.Printf("Response from %s aborted: exceeds %d bytes", r.Host, config.Cfg.Filter.MaxResponseSize)
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
 }
 
 // handleHTTPS handles HTTPS CONNECT tunnel requests
@@ -232,6 +620,16 @@ func (h *ProxyHandler) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 		host += ":443"
 	}
 
+	// Apply fault injection rules
+	fault := h.chaos.match(r)
+	fault.delay()
+	if status := fault.status(); status != 0 {
+		logChaos(fault, r, fmt.Sprintf("synthetic status %d", status))
+		http.Error(w, http.StatusText(status)+" (injected by MLCProxy)", status)
+		stats.LogRequestDetails(r, status, 0, 0, stats.RequestDetails{Source: "chaos"})
+		return
+	}
+
 	// Hijack the connection
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -249,22 +647,57 @@ func (h *ProxyHandler) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer clientConn.Close()
+	h.tunnel(clientConn, r, host, fault, true)
+}
+
+// tunnel connects clientConn with host and copies data in both directions.
+// answerConnect sends the response to the CONNECT request r; transparently
+// redirected connections expect none.
+func (h *ProxyHandler) tunnel(clientConn net.Conn, r *http.Request, host string, fault *chaosFault, answerConnect bool) {
+	// Terminate TLS locally if interception is enabled. The decrypted
+	// requests open their own upstream connections.
+	if h.authority != nil {
+		if answerConnect {
+			if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+				log.Printf("Failed to send 200 response: %v", err)
+				return
+			}
+		}
+		h.interceptTLS(clientConn, r, host)
+		return
+	}
 
 	// Connect to target
-	targetConn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	dns := &dnsTimer{}
+	targetConn, err := h.dialUpstream(dns.context(context.Background()), h.outboundFor(r), "tcp", host)
 	if err != nil {
 		log.Printf("Failed to connect to %s: %v", host, err)
-		clientConn.Write([]byte(fmt.Sprintf("HTTP/1.1 504 Gateway Timeout\r\n\r\n")))
+		if answerConnect {
+			clientConn.Write([]byte(fmt.Sprintf("HTTP/1.1 504 Gateway Timeout\r\n\r\n")))
+		}
 		return
 	}
 	defer targetConn.Close()
 
 	// Send connection established response
-	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
-	if err != nil {
-		log.Printf("Failed to send 200 response: %v", err)
+	if answerConnect {
+		_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		if err != nil {
+			log.Printf("Failed to send 200 response: %v", err)
+			return
+		}
+	}
+	if err := sendProxyHeader(targetConn, r.RemoteAddr, host); err != nil {
+		log.Printf("Failed to send PROXY header to %s: %v", host, err)
+		return
+	}
+	if fault.resetTunnel() {
+		logChaos(fault, r, "tunnel reset")
+		resetConn(clientConn)
+		stats.LogRequestDetails(r, http.StatusOK, 0, 0, stats.RequestDetails{Source: "chaos"})
 		return
 	}
+
 	// Set up traffic tracking
 	clientReader := NewTrackingReader(clientConn)
 	targetReader := NewTrackingReader(targetConn)
@@ -272,22 +705,54 @@ func (h *ProxyHandler) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 	// Create bidirectional tunnel
 	done := make(chan bool, 2)
 
-	// Client -> Target tunnel
+	// Target -> Client tunnel (started first so server-first protocols are not delayed by peeking)
 	go func() {
-		io.Copy(targetConn, clientReader)
-		targetConn.(*net.TCPConn).CloseWrite()
+		_, err := io.Copy(clientConn, fault.wrap(targetReader))
+		if errors.Is(err, errChaosDrop) {
+			logChaos(fault, r, "tunnel reset")
+			resetConn(clientConn)
+		} else {
+			closeWrite(clientConn)
+		}
 		done <- true
 	}()
 
-	// Target -> Client tunnel
-	go func() {
-		io.Copy(clientConn, targetReader)
-		clientConn.(*net.TCPConn).CloseWrite()
-		done <- true
-	}()
+	// Peek at the TLS ClientHello to learn the real hostname
+	details := stats.RequestDetails{DNS: dns.duration()}
+	if config.Cfg.Security.PeekSNI {
+		clientConn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+		hello, peeked := peekClientHello(clientReader)
+		clientConn.SetReadDeadline(time.Time{})
+
+		if hello != nil {
+			details.SNI = hello.ServerName
+			details.ALPN = hello.ALPN
+			if hello.ServerName != "" && !h.authManager.IsDestinationAllowed(hello.ServerName) {
+				log.Printf("Tunnel to %s closed - SNI %s is not allowed", host, hello.ServerName)
+				stats.LogRequestDetails(r, http.StatusForbidden, int64(clientReader.BytesRead()), int64(targetReader.BytesRead()), details)
+				return
+			}
+			if list := h.blocklists.Match(getClientIP(r), hello.ServerName); list != "" {
+				log.Printf("Tunnel to %s closed - SNI %s is on blocklist %s", host, hello.ServerName, list)
+				stats.LogBlocked(list)
+				details.Source = "blocklist"
+				stats.LogRequestDetails(r, http.StatusForbidden, int64(clientReader.BytesRead()), int64(targetReader.BytesRead()), details)
+				return
+			}
+		}
+		// Replay the peeked bytes unchanged
+		if _, err := targetConn.Write(peeked); err != nil {
+			log.Printf("Failed to forward ClientHello to %s: %v", host, err)
+			stats.LogRequestDetails(r, http.StatusBadGateway, int64(clientReader.BytesRead()), int64(targetReader.BytesRead()), details)
+			return
+		}
+	}
+
+	// Client -> Target tunnel
+	go copyHalf(targetConn, clientReader, done)
 
 	// Wait for either direction to finish
 	<-done
 	// Log transfer statistics
-	stats.LogRequest(r, http.StatusOK, int64(clientReader.BytesRead()), int64(targetReader.BytesRead()))
+	stats.LogRequestDetails(r, http.StatusOK, int64(clientReader.BytesRead()), int64(targetReader.BytesRead()), details)
 }
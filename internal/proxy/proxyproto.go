@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"mlc_goproxy/internal/config"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol (https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt)
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener expects a PROXY protocol header on connections from
+// trusted sources. Other connections are passed through unchanged.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []string // IPs or CIDR networks
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !ipInList(host, l.trusted) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn}, nil
+}
+
+// proxyProtoConn reports the client address from the PROXY header. The
+// header is read on first use, so a slow sender does not block Accept.
+type proxyProtoConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr // nil if the header carries no address (LOCAL, UNKNOWN)
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("Invalid PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// readProxyHeader reads a version 1 or 2 header and returns the source
+// address it carries
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(start) == "PROXY" {
+		return readProxyHeaderV1(r)
+	}
+	if sig, err := r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(sig, proxyV2Signature) {
+		return nil, fmt.Errorf("missing header")
+	}
+	return readProxyHeaderV2(r)
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	port, perr := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil || perr != nil {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyHeaderV2 parses the binary header: signature, version/command,
+// family/protocol, length and the addresses followed by optional TLVs
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, e.g. health checks of the load balancer
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", header[12]&0x0f)
+	}
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address block")
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address block")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	// AF_UNSPEC or AF_UNIX: keep the connection address
+	return nil, nil
+}
+
+// sendProxyHeader writes a PROXY header to conn if host matches
+// proxy_protocol_hosts in [outbound]. client is the address of the client
+// the tunnel belongs to.
+func sendProxyHeader(conn net.Conn, client, host string) error {
+	if !matchHostList(config.Cfg.Outbound.ProxyProtocolHosts, hostname(host)) {
+		return nil
+	}
+	src, _ := netip.ParseAddrPort(client)
+	var dst netip.AddrPort
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		dst = tcp.AddrPort()
+	}
+	_, err := conn.Write(proxyHeader(config.Cfg.Outbound.ProxyProtocolVersion, src, dst))
+	return err
+}
+
+// proxyHeader encodes a header for a connection from src to dst. Invalid
+// addresses yield an UNKNOWN (v1) or LOCAL (v2) header.
+func proxyHeader(version int, src, dst netip.AddrPort) []byte {
+	valid := src.IsValid() && dst.IsValid()
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if valid && srcIP.Is4() != dstIP.Is4() {
+		// Both addresses must be of the same family
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+
+	if version == 1 {
+		if !valid {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if srcIP.Is4() {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, src.Port(), dst.Port())
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	if !valid {
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	family := byte(0x21) // AF_INET6, STREAM
+	if srcIP.Is4() {
+		family = 0x11 // AF_INET, STREAM
+	}
+	addrs = append(addrs, srcIP.AsSlice()...)
+	addrs = append(addrs, dstIP.AsSlice()...)
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
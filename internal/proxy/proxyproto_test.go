@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mlc_goproxy/internal/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// v2Header builds a version 2 header from the version/command and
+// family/protocol bytes and the address block
+func v2Header(verCmd, family byte, body ...byte) string {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, verCmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return string(append(header, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0x30, 0x39, 0x01, 0xbb}
+	ipv6 := append(append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...), 0x30, 0x39, 0x01, 0xbb)
+	mapped := append(append(netip.MustParseAddr("::ffff:192.0.2.1").AsSlice(), netip.MustParseAddr("::ffff:198.51.100.2").AsSlice()...), 0x30, 0x39, 0x01, 0xbb)
+	tlv := append(append([]byte(nil), ipv4...), 0x04, 0x00, 0x02, 'h', 'i') // PP2_TYPE_NOOP
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string // source address, "" = none
+		wantErr bool
+	}{
+		{name: "v1 TCP4", input: "PROXY TCP4 192.0.2.1 198.51.100.2 12345 443\r\n", want: "192.0.2.1:12345"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", want: "[2001:db8::1]:12345"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN ff::1 ff::2 1 2\r\n"},
+		{name: "v1 UDP4", input: "PROXY UDP4 192.0.2.1 198.51.100.2 12345 443\r\n", wantErr: true},
+		{name: "v1 missing port", input: "PROXY TCP4 192.0.2.1 198.51.100.2 12345\r\n", wantErr: true},
+		{name: "v1 invalid address", input: "PROXY TCP4 192.0.2.300 198.51.100.2 12345 443\r\n", wantErr: true},
+		{name: "v1 port out of range", input: "PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n", wantErr: true},
+		{name: "v1 without CRLF", input: "PROXY TCP4 192.0.2.1 198.51.100.2 12345 443\n", wantErr: true},
+		{name: "v1 too long", input: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+		{name: "v2 IPv4", input: v2Header(0x21, 0x11, ipv4...), want: "192.0.2.1:12345"},
+		{name: "v2 IPv6", input: v2Header(0x21, 0x21, ipv6...), want: "[2001:db8::1]:12345"},
+		{name: "v2 IPv4-mapped IPv6", input: v2Header(0x21, 0x21, mapped...), want: "192.0.2.1:12345"},
+		{name: "v2 with TLV", input: v2Header(0x21, 0x11, tlv...), want: "192.0.2.1:12345"},
+		{name: "v2 LOCAL", input: v2Header(0x20, 0x00)},
+		{name: "v2 LOCAL with addresses", input: v2Header(0x20, 0x11, ipv4...)},
+		{name: "v2 AF_UNSPEC", input: v2Header(0x21, 0x00)},
+		{name: "v2 AF_UNIX", input: v2Header(0x21, 0x31, make([]byte, 216)...)},
+		{name: "v2 version 1", input: v2Header(0x11, 0x11, ipv4...), wantErr: true},
+		{name: "v2 unknown command", input: v2Header(0x22, 0x11, ipv4...), wantErr: true},
+		{name: "v2 short IPv4 block", input: v2Header(0x21, 0x11, ipv4[:8]...), wantErr: true},
+		{name: "v2 short IPv6 block", input: v2Header(0x21, 0x21, ipv6[:32]...), wantErr: true},
+		{name: "v2 truncated", input: v2Header(0x21, 0x11, ipv4...)[:20], wantErr: true},
+		{name: "no header", input: "GET / HTTP/1.1\r\n\r\n", wantErr: true},
+		{name: "empty", input: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Data after the header must stay readable
+			r := bufio.NewReader(strings.NewReader(tc.input + "payload"))
+			addr, err := readProxyHeader(r)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Errorf("source = %q, want %q", got, tc.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("data after the header = %q, want %q", rest, "payload")
+			}
+		})
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	v4 := netip.MustParseAddrPort("192.0.2.1:12345")
+	v4dst := netip.MustParseAddrPort("198.51.100.2:443")
+	v6 := netip.MustParseAddrPort("[2001:db8::1]:12345")
+	v6dst := netip.MustParseAddrPort("[2001:db8::2]:443")
+
+	t.Run("v1 encoding", func(t *testing.T) {
+		for _, tc := range []struct {
+			src, dst netip.AddrPort
+			want     string
+		}{
+			{src: v4, dst: v4dst, want: "PROXY TCP4 192.0.2.1 198.51.100.2 12345 443\r\n"},
+			{src: v6, dst: v6dst, want: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"},
+			{src: v4, dst: v6dst, want: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 12345 443\r\n"},
+			{src: netip.AddrPort{}, dst: v4dst, want: "PROXY UNKNOWN\r\n"},
+		} {
+			if got := string(proxyHeader(1, tc.src, tc.dst)); got != tc.want {
+				t.Errorf("proxyHeader(1, %v, %v) = %q, want %q", tc.src, tc.dst, got, tc.want)
+			}
+		}
+	})
+
+	for _, version := range []int{1, 2} {
+		for _, tc := range []struct {
+			name     string
+			src, dst netip.AddrPort
+			want     netip.AddrPort // zero: no address
+		}{
+			{name: "IPv4", src: v4, dst: v4dst, want: v4},
+			{name: "IPv6", src: v6, dst: v6dst, want: v6},
+			{name: "IPv4 to IPv6", src: v4, dst: v6dst, want: v4},
+			{name: "IPv6 to IPv4", src: v6, dst: v4dst, want: v6},
+			{name: "mapped source", src: netip.MustParseAddrPort("[::ffff:192.0.2.1]:12345"), dst: v4dst, want: v4},
+			{name: "no source", dst: v4dst},
+			{name: "no destination", src: v4},
+		} {
+			t.Run(fmt.Sprintf("round trip v%d %s", version, tc.name), func(t *testing.T) {
+				header := proxyHeader(version, tc.src, tc.dst)
+				addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(string(header))))
+				if err != nil {
+					t.Fatalf("reading %q: %v", header, err)
+				}
+				var got netip.AddrPort
+				if addr != nil {
+					got = addr.(*net.TCPAddr).AddrPort()
+					got = netip.AddrPortFrom(got.Addr().Unmap(), got.Port())
+				}
+				if got != tc.want {
+					t.Errorf("source = %v, want %v", got, tc.want)
+				}
+			})
+		}
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	plain := &config.Listener{Name: "plain"}
+	haproxy := &config.Listener{Name: "haproxy", ProxyProtocol: true, ProxyProtocolFrom: []string{"10.0.0.5"}}
+
+	tests := []struct {
+		name     string
+		listener *config.Listener
+		remote   string
+		xff      string
+		want     string
+	}{
+		{name: "remote address", listener: plain, remote: "192.0.2.1:4711", want: "192.0.2.1"},
+		{name: "IPv6 remote address", listener: plain, remote: "[2001:db8::1]:4711", want: "2001:db8::1"},
+		{name: "X-Forwarded-For", listener: plain, remote: "192.0.2.1:4711", xff: "198.51.100.7, 192.0.2.1", want: "198.51.100.7"},
+		{name: "PROXY address", listener: haproxy, remote: "198.51.100.7:4711", want: "198.51.100.7"},
+		{name: "X-Forwarded-For ignored behind PROXY", listener: haproxy, remote: "198.51.100.7:4711", xff: "10.0.0.1", want: "198.51.100.7"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), listenerKey{}, tc.listener))
+			r.RemoteAddr = tc.remote
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if got := getClientIP(r); got != tc.want {
+				t.Errorf("getClientIP() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mlc_goproxy/internal/capture"
+	"mlc_goproxy/internal/cassette"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/stats"
+	"net/http"
+	"strconv"
+)
+
+// replayFromCassette answers req from the cassette directory. It returns true
+// if the response has been written (either a recording or a strict-mode 502)
+// and false if the request should be forwarded upstream.
+func (h *ProxyHandler) replayFromCassette(w http.ResponseWriter, r *http.Request, req *http.Request) bool {
+	mode := config.Cfg.Replay.Mode
+	if h.cassettes == nil || (mode != cassette.ModeReplay && mode != cassette.ModeHybrid) {
+		return false
+	}
+
+	recording, err := h.cassettes.Lookup(req.Method, req.URL.String(), req.Header)
+	if err != nil {
+		if !errors.Is(err, cassette.ErrNotFound) {
+			log.Printf("Error reading cassette for %s: %v", req.URL, err)
+		}
+		if mode == cassette.ModeHybrid {
+			return false
+		}
+		log.Printf("Replay miss for %s %s", req.Method, req.URL)
+		http.Error(w, "No recording for "+req.Method+" "+req.URL.String(), http.StatusBadGateway)
+		stats.LogRequestDetails(r, http.StatusBadGateway, 0, 0, stats.RequestDetails{Source: "replay"})
+		return true
+	}
+
+	copyHeader(w.Header(), recording.Header)
+	w.Header().Set("Content-Length", strconv.Itoa(len(recording.Body)))
+	w.Header().Set("X-MLCProxy-Replay", recording.RecordedAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(recording.Status)
+	w.Write(recording.Body)
+	stats.LogRequestDetails(r, recording.Status, 0, int64(len(recording.Body)), stats.RequestDetails{Source: "replay"})
+	return true
+}
+
+// cassetteRecording buffers an upstream response for the cassette directory.
+// Methods are safe to call on a nil receiver, which means "not recording".
+type cassetteRecording struct {
+	req  *http.Request
+	body *capture.LimitedBuffer
+}
+
+// startRecording returns a recording if responses to req should be stored
+func (h *ProxyHandler) startRecording(req *http.Request) *cassetteRecording {
+	mode := config.Cfg.Replay.Mode
+	if h.cassettes == nil || (mode != cassette.ModeRecord && mode != cassette.ModeHybrid) {
+		return nil
+	}
+	return &cassetteRecording{
+		req:  req,
+		body: capture.NewLimitedBuffer(config.Cfg.Replay.MaxBodySize),
+	}
+}
+
+// teeResponse returns a reader that copies the response body into the recording
+func (c *cassetteRecording) teeResponse(body io.Reader) io.Reader {
+	if c == nil {
+		return body
+	}
+	return io.TeeReader(body, c.body)
+}
+
+// save writes the recorded response to the cassette directory. Incomplete
+// or oversized bodies are not stored.
+func (c *cassetteRecording) save(store *cassette.Store, resp *http.Response, copyErr error) {
+	if c == nil {
+		return
+	}
+	if copyErr != nil || c.body.Truncated {
+		log.Printf("Not recording %s: response incomplete or larger than %d bytes", c.req.URL, config.Cfg.Replay.MaxBodySize)
+		return
+	}
+
+	header := resp.Header.Clone()
+	// Content-Length is recomputed on replay
+	header.Del("Content-Length")
+	if err := store.Save(c.req.Method, c.req.URL.String(), c.req.Header, resp.StatusCode, header, c.body.Bytes()); err != nil {
+		log.Printf("Error recording %s: %v", c.req.URL, err)
+	}
+}
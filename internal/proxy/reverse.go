@@ -0,0 +1,247 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/stats"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// reverseSite is a compiled config.ReverseSite
+type reverseSite struct {
+	config.ReverseSite
+	backends []*reverseBackend
+	request  headerActions
+	response headerActions
+	next     atomic.Uint64 // round robin counter
+}
+
+type reverseBackend struct {
+	url     *url.URL
+	healthy atomic.Bool
+}
+
+// compileReverseSites validates the configured reverse proxy sites
+func compileReverseSites(sites []config.ReverseSite) ([]*reverseSite, error) {
+	var compiled []*reverseSite
+	for _, s := range sites {
+		if !s.Enabled {
+			continue
+		}
+		if len(s.Hosts) == 0 || len(s.Backends) == 0 {
+			return nil, fmt.Errorf("reverse site %s: hosts and backends are required", s.Name)
+		}
+		if !strings.HasPrefix(s.PathPrefix, "/") {
+			return nil, fmt.Errorf("reverse site %s: path_prefix must start with /", s.Name)
+		}
+		site := &reverseSite{ReverseSite: s}
+		for _, spec := range s.Backends {
+			u, err := url.Parse(spec)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("reverse site %s: invalid backend URL %q", s.Name, spec)
+			}
+			b := &reverseBackend{url: u}
+			b.healthy.Store(true)
+			site.backends = append(site.backends, b)
+		}
+		var err error
+		if site.request, err = compileHeaderActions(s.Request); err != nil {
+			return nil, fmt.Errorf("reverse site %s: request %w", s.Name, err)
+		}
+		if site.response, err = compileHeaderActions(s.Response); err != nil {
+			return nil, fmt.Errorf("reverse site %s: response %w", s.Name, err)
+		}
+		compiled = append(compiled, site)
+	}
+	return compiled, nil
+}
+
+// matchReverse returns the site for an origin-form request to one of the
+// published host names, preferring the longest path prefix
+func (h *ProxyHandler) matchReverse(r *http.Request) *reverseSite {
+	if r.URL.Host != "" || r.Method == http.MethodConnect {
+		return nil
+	}
+	var match *reverseSite
+	host := hostname(r.Host)
+	for _, site := range h.reverse {
+		if _, ok := mapPath(r.URL.Path, site.PathPrefix, ""); !ok || !matchHostList(site.Hosts, host) {
+			continue
+		}
+		if match == nil || len(site.PathPrefix) > len(match.PathPrefix) {
+			match = site
+		}
+	}
+	return match
+}
+
+// pick returns the next healthy backend, nil if all are down
+func (site *reverseSite) pick() *reverseBackend {
+	n := uint64(len(site.backends))
+	start := site.next.Add(1)
+	for i := range n {
+		if b := site.backends[(start+i)%n]; b.healthy.Load() {
+			return b
+		}
+	}
+	return nil
+}
+
+// watchHealth checks the backends of site periodically until the process exits
+func (h *ProxyHandler) watchHealth(site *reverseSite) {
+	if site.HealthCheck == "" || site.HealthInterval <= 0 {
+		return
+	}
+	client := &http.Client{
+		Timeout:   site.HealthTimeout,
+		Transport: h.transportFor(globalBinding()),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	check := func(b *reverseBackend) {
+		u := *b.url
+		u.Path, u.RawPath, u.RawQuery = site.HealthCheck, "", ""
+		healthy := false
+		resp, err := client.Get(u.String())
+		if err == nil {
+			resp.Body.Close()
+			healthy = resp.StatusCode < 400
+			if !healthy {
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+		}
+		if b.healthy.Swap(healthy) != healthy {
+			if healthy {
+				log.Printf("Reverse site %s: backend %s is up again", site.Name, b.url)
+			} else {
+				log.Printf("Reverse site %s: backend %s is down: %v", site.Name, b.url, err)
+			}
+		}
+	}
+	go func() {
+		for {
+			for _, b := range site.backends {
+				check(b)
+			}
+			time.Sleep(site.HealthInterval)
+		}
+	}()
+}
+
+// handleReverse forwards an origin-form request to a backend of site. The
+// request runs through handleHTTP, so rewrites, filters and stats apply as
+// for proxy requests.
+func (h *ProxyHandler) handleReverse(w http.ResponseWriter, r *http.Request, site *reverseSite) {
+	clientIP := remoteIP(r) // X-Forwarded-For is set by the client, not trusted here
+	networks := site.AllowedNetworks
+	if len(networks) == 0 {
+		networks = allowedNetworks(r)
+	}
+	if !h.authManager.IsIPAllowedIn(clientIP, networks) {
+		http.Error(w, fmt.Sprintf("Access denied - IP %s not in allowed networks", clientIP), http.StatusForbidden)
+		stats.LogRequestDetails(r, http.StatusForbidden, 0, 0, stats.RequestDetails{Source: "reverse"})
+		return
+	}
+
+	b := site.pick()
+	if b == nil {
+		log.Printf("Reverse site %s: no healthy backend for %s%s", site.Name, r.Host, r.URL.Path)
+		http.Error(w, "No healthy backend available", http.StatusServiceUnavailable)
+		stats.LogRequestDetails(r, http.StatusServiceUnavailable, 0, 0, stats.RequestDetails{Source: "reverse"})
+		return
+	}
+
+	target := &reverseTarget{site: site, backend: b, host: r.Host, scheme: "http"}
+	if r.TLS != nil {
+		target.scheme = "https"
+	}
+	u := *b.url
+	u.Path, _ = mapPath(r.URL.Path, site.PathPrefix, b.url.Path)
+	u.RawPath, u.RawQuery = "", r.URL.RawQuery
+	log.Printf("Reverse proxy request: %s %s%s -> %s from IP %s", r.Method, r.Host, r.URL.Path, u.String(), clientIP)
+
+	r.URL = &u
+	h.handleHTTP(w, r.WithContext(context.WithValue(r.Context(), reverseKey{}, target)))
+}
+
+type reverseKey struct{}
+
+// reverseTarget is the backend chosen for a reverse proxy request
+type reverseTarget struct {
+	site    *reverseSite
+	backend *reverseBackend
+	host    string // public host name
+	scheme  string // public scheme
+}
+
+// reverseTargetOf returns the backend of a reverse proxy request, nil for
+// proxy requests
+func reverseTargetOf(r *http.Request) *reverseTarget {
+	t, _ := r.Context().Value(reverseKey{}).(*reverseTarget)
+	return t
+}
+
+// request adds the X-Forwarded headers and applies the header actions of the
+// site to the outgoing request. It is safe to call on a nil target.
+func (t *reverseTarget) request(req *http.Request, r *http.Request) {
+	if t == nil {
+		return
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	req.Header.Set("X-Forwarded-Host", t.host)
+	req.Header.Set("X-Forwarded-Proto", t.scheme)
+	if t.site.PreserveHost {
+		req.Host = t.host
+	}
+	t.site.request.apply(req.Header)
+}
+
+// response maps redirects to the backend back to the public URL and applies
+// the header actions of the site. It is safe to call on a nil target.
+func (t *reverseTarget) response(header http.Header) {
+	if t == nil {
+		return
+	}
+	if loc := header.Get("Location"); loc != "" {
+		if u, err := url.Parse(loc); err == nil && u.Host == t.backend.url.Host {
+			if p, ok := mapPath(u.Path, t.backend.url.Path, t.site.PathPrefix); ok {
+				u.Scheme, u.Host, u.Path, u.RawPath = t.scheme, t.host, p, ""
+				header.Set("Location", u.String())
+			}
+		}
+	}
+	t.site.response.apply(header)
+}
+
+// mapPath replaces the path prefix from of p with to. It reports false if p
+// is not below from.
+func mapPath(p, from, to string) (string, bool) {
+	from = strings.TrimSuffix(from, "/")
+	if p != from && !strings.HasPrefix(p, from+"/") {
+		return "", false
+	}
+	mapped := strings.TrimSuffix(to, "/") + strings.TrimPrefix(p, from)
+	if mapped == "" {
+		mapped = "/"
+	}
+	return mapped, true
+}
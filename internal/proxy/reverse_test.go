@@ -0,0 +1,49 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"mlc_goproxy/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReverseAllowedNetworks(t *testing.T) {
+	// The only backend is down: admitted requests end with 503
+	site := &reverseSite{
+		ReverseSite: config.ReverseSite{Name: "ui", AllowedNetworks: []string{"192.168.0.0/16"}},
+		backends:    []*reverseBackend{{}},
+	}
+	h := &ProxyHandler{authManager: &AuthManager{}}
+
+	tests := []struct {
+		name       string
+		remote     string
+		xff        string
+		wantStatus int
+	}{
+		{name: "allowed network", remote: "192.168.1.10:4711", wantStatus: http.StatusServiceUnavailable},
+		{name: "other network", remote: "203.0.113.5:4711", wantStatus: http.StatusForbidden},
+		{name: "forged X-Forwarded-For", remote: "203.0.113.5:4711", xff: "192.168.1.10", wantStatus: http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = "ui.example"
+			r.RemoteAddr = tc.remote
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			w := httptest.NewRecorder()
+			h.handleReverse(w, r, site)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
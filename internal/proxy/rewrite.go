@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// regexReplace is a compiled "<expr> => <replacement>" rule
+type regexReplace struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func compileRegexReplace(spec string) (*regexReplace, error) {
+	expr, replacement, ok := strings.Cut(spec, "=>")
+	if !ok {
+		return nil, fmt.Errorf(`expected "<regex> => <replacement>", got %q`, spec)
+	}
+	re, err := regexp.Compile(strings.TrimSpace(expr))
+	if err != nil {
+		return nil, err
+	}
+	return &regexReplace{re: re, replacement: strings.TrimSpace(replacement)}, nil
+}
+
+func (rr *regexReplace) apply(s string) string {
+	return rr.re.ReplaceAllString(s, rr.replacement)
+}
+
+// headerActions is a compiled config.HeaderRewrite
+type headerActions struct {
+	config.HeaderRewrite
+	replace map[string]*regexReplace
+}
+
+func compileHeaderActions(hr config.HeaderRewrite) (headerActions, error) {
+	actions := headerActions{HeaderRewrite: hr, replace: make(map[string]*regexReplace)}
+	for name, spec := range hr.Replace {
+		rr, err := compileRegexReplace(spec)
+		if err != nil {
+			return actions, fmt.Errorf("header %s: %w", name, err)
+		}
+		actions.replace[name] = rr
+	}
+	return actions, nil
+}
+
+// apply runs remove, replace, set and add (in this order) on h
+func (a headerActions) apply(h http.Header) {
+	for _, name := range a.Remove {
+		h.Del(name)
+	}
+	for name, rr := range a.replace {
+		values := h.Values(name)
+		for i, v := range values {
+			values[i] = rr.apply(v)
+		}
+	}
+	for name, value := range a.Set {
+		h.Set(name, value)
+	}
+	for name, value := range a.Add {
+		h.Add(name, value)
+	}
+}
+
+// rewriteRule is a compiled config.RewriteRule
+type rewriteRule struct {
+	config.RewriteRule
+	request    headerActions
+	response   headerActions
+	urlRewrite *regexReplace
+}
+
+// compileRewriteRules validates the configured rewrite rules
+func compileRewriteRules(rules []config.RewriteRule) ([]*rewriteRule, error) {
+	var compiled []*rewriteRule
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		rule := &rewriteRule{RewriteRule: r}
+		var err error
+		if rule.request, err = compileHeaderActions(r.Request); err != nil {
+			return nil, fmt.Errorf("rewrite rule %s: request %w", r.Name, err)
+		}
+		if rule.response, err = compileHeaderActions(r.Response); err != nil {
+			return nil, fmt.Errorf("rewrite rule %s: response %w", r.Name, err)
+		}
+		if r.URLRewrite != "" {
+			if rule.urlRewrite, err = compileRegexReplace(r.URLRewrite); err != nil {
+				return nil, fmt.Errorf("rewrite rule %s: url_rewrite: %w", r.Name, err)
+			}
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+func (rule *rewriteRule) matches(r *http.Request) bool {
+	if rule.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	if len(rule.Hosts) == 0 {
+		return true
+	}
+	return matchHostList(rule.Hosts, hostname(r.Host))
+}
+
+// rewriteSet is the list of rules matching one request. A nil set is valid.
+type rewriteSet []*rewriteRule
+
+// matchRewrites returns all rewrite rules matching the client request r
+func (h *ProxyHandler) matchRewrites(r *http.Request) rewriteSet {
+	var set rewriteSet
+	for _, rule := range h.rewrites {
+		if rule.matches(r) {
+			set = append(set, rule)
+		}
+	}
+	return set
+}
+
+// request applies URL rewrites, host redirects and request header actions
+// to the outgoing request
+func (set rewriteSet) request(req *http.Request) {
+	for _, rule := range set {
+		if rule.urlRewrite != nil {
+			rewritten := rule.urlRewrite.apply(req.URL.String())
+			if u, err := url.Parse(rewritten); err == nil && u.Host != "" {
+				req.URL = u
+				req.Host = u.Host
+			} else {
+				log.Printf("Rewrite rule %s produced invalid URL %q", rule.Name, rewritten)
+			}
+		}
+		if rule.RedirectHost != "" {
+			req.URL.Host = rule.RedirectHost
+			if !rule.PreserveHost {
+				req.Host = rule.RedirectHost
+			}
+		}
+		rule.request.apply(req.Header)
+
+		// net/http sends its own User-Agent unless the header is present but empty
+		if slices.ContainsFunc(rule.Request.Remove, func(name string) bool {
+			return strings.EqualFold(name, "User-Agent")
+		}) && req.Header.Get("User-Agent") == "" {
+			req.Header["User-Agent"] = []string{""}
+		}
+	}
+}
+
+// response applies the response header actions
+func (set rewriteSet) response(h http.Header) {
+	for _, rule := range set {
+		rule.response.apply(h)
+	}
+}
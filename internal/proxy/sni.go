@@ -0,0 +1,64 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// sniPeekTimeout limits how long a tunnel waits for the client's first bytes
+const sniPeekTimeout = 5 * time.Second
+
+// errHelloCaptured aborts the handshake once the ClientHello has been parsed
+var errHelloCaptured = errors.New("client hello captured")
+
+// ClientHello holds the values extracted from a peeked TLS ClientHello
+type ClientHello struct {
+	ServerName string
+	ALPN       []string
+}
+
+// peekClientHello reads the TLS ClientHello from r without terminating TLS.
+// It returns the parsed hello (nil if the client does not speak TLS) and all
+// bytes consumed from r, which the caller must replay to the target.
+func peekClientHello(r io.Reader) (*ClientHello, []byte) {
+	var peeked bytes.Buffer
+	var hello *ClientHello
+
+	conn := &readOnlyConn{r: io.TeeReader(r, &peeked)}
+	tls.Server(conn, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &ClientHello{
+				ServerName: info.ServerName,
+				ALPN:       append([]string(nil), info.SupportedProtos...),
+			}
+			return nil, errHelloCaptured
+		},
+	}).Handshake()
+
+	return hello, peeked.Bytes()
+}
+
+// readOnlyConn feeds a reader into crypto/tls. Writes are discarded so the
+// handshake can never send anything to the real client.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,145 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the listener certificate and reloads it when the files
+// change, so renewed certificates are picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the key pair if one of the files is newer than the loaded one
+func (c *certReloader) load() error {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// Do not retry the same broken files on every handshake
+		c.modTime = modTime
+		return err
+	}
+	if c.cert != nil {
+		log.Printf("Listener certificate %s reloaded", c.certFile)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A broken update keeps
+// the previous certificate in use.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		log.Printf("Reloading listener certificate %s failed, keeping the previous one: %v", c.certFile, err)
+	}
+	return c.cert, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// listenerTLSConfig returns the server configuration of an https listener.
+// With a client CA, verified client certificates authenticate the user;
+// auth = cert makes them mandatory.
+func listenerTLSConfig(l config.Listener) (*tls.Config, error) {
+	if l.TLSCert == "" || l.TLSKey == "" {
+		return nil, fmt.Errorf("tls_cert and tls_key are required for protocol https")
+	}
+	certs, err := newCertReloader(l.TLSCert, l.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		// CONNECT tunnels hijack the connection, which HTTP/2 does not allow
+		NextProtos: []string{"http/1.1"},
+	}
+	if l.ClientCA == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(l.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", l.ClientCA)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if l.Auth == "cert" {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+type certUserKey struct{}
+
+// certUser returns the user of the verified client certificate of r: the
+// mapped name from cert_user.<CN>, or the common name if no mapping is
+// configured
+func certUser(r *http.Request) (string, bool) {
+	// Requests inside intercepted tunnels carry the user of the CONNECT request
+	if user, ok := r.Context().Value(certUserKey{}).(string); ok {
+		return user, true
+	}
+	l := listenerOf(r)
+	if l == nil || l.ClientCA == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(l.CertUsers) == 0 {
+		return cn, cn != ""
+	}
+	user, ok := l.CertUsers[cn]
+	return user, ok
+}
@@ -0,0 +1,151 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/stats"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// serveTransparent accepts connections redirected to l by iptables
+// (REDIRECT or TPROXY) until the listener fails
+func (l *proxyListener) serveTransparent(h *ProxyHandler) error {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return err
+		}
+		go h.handleTransparent(conn, &l.Listener)
+	}
+}
+
+// handleTransparent serves one redirected connection. TLS is tunneled to the
+// host from the SNI, plain HTTP is proxied using the Host header. Both fall
+// back to the original destination.
+func (h *ProxyHandler) handleTransparent(conn net.Conn, l *config.Listener) {
+	defer conn.Close()
+
+	dst, err := originalDst(conn)
+	if l.TProxy {
+		// TPROXY keeps the original destination as local address
+		dst, err = conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	if err != nil {
+		log.Printf("Transparent connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if !l.TProxy && dst.String() == conn.LocalAddr().String() {
+		log.Printf("Transparent connection from %s was not redirected, closing it to avoid a loop", conn.RemoteAddr())
+		return
+	}
+
+	ctx := stats.WithListener(context.WithValue(context.Background(), listenerKey{}, l), l.Name)
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+
+	// TLS handshake record
+	if first[0] == 0x16 {
+		hello, peeked := peekClientHello(reader)
+		client := &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), reader)}
+		host := dst.String()
+		if hello != nil && hello.ServerName != "" {
+			host = net.JoinHostPort(hello.ServerName, strconv.Itoa(dst.Port))
+		}
+		r := (&http.Request{
+			Method:     http.MethodConnect,
+			URL:        &url.URL{Host: host},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Host:       host,
+			RemoteAddr: conn.RemoteAddr().String(),
+		}).WithContext(ctx)
+
+		// Denied connections are closed, there is no way to send an error
+		if !h.admit(discardResponseWriter{}, r) {
+			return
+		}
+		log.Printf("Transparent TLS connection to %s (original destination %s) from IP %s", host, dst, getClientIP(r))
+		fault := h.chaos.match(r)
+		fault.delay()
+		if status := fault.status(); status != 0 {
+			logChaos(fault, r, "connection closed")
+			stats.LogRequestDetails(r, status, 0, 0, stats.RequestDetails{Source: "chaos"})
+			return
+		}
+		h.tunnel(client, r, host, fault, false)
+		return
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	server := &http.Server{
+		BaseContext: func(net.Listener) context.Context { return ctx },
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Origin-form requests: complete the URL from the Host header
+			if r.Host == "" {
+				r.Host = dst.String()
+			}
+			r.URL.Scheme = "http"
+			r.URL.Host = r.Host
+			if !h.admit(w, r) {
+				return
+			}
+			log.Printf("Transparent request: %s %s %s from IP %s", r.Method, r.Host, r.URL.String(), getClientIP(r))
+			h.handleHTTP(w, r)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				once.Do(func() { close(done) })
+			}
+		},
+	}
+	go server.Serve(newSingleConnListener(&replayConn{Conn: conn, r: reader}))
+	<-done
+	server.Close()
+}
+
+// replayConn reads from r, which returns bytes already consumed from Conn
+// before the rest of the stream
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *replayConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// discardResponseWriter drops responses for connections that cannot receive
+// them
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header         { return make(http.Header) }
+func (discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (discardResponseWriter) WriteHeader(int)             {}
@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mlc_goproxy/internal/config"
+	"mlc_goproxy/internal/stats"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpForward is an opened UDP config.Forward. Each client address gets its
+// own outbound socket, so replies can be mapped back.
+type udpForward struct {
+	config.Forward
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	sessions map[string]*udpSession // client addr:port -> session
+}
+
+// udpQueueSize is the number of datagrams a session buffers while its
+// socket is connecting or the target is slow; further ones are dropped
+const udpQueueSize = 64
+
+// udpSession is the outbound socket of one client address. Sessions of
+// clients that are not allowed have no queue, they only keep the denial from
+// being checked and logged for every datagram.
+type udpSession struct {
+	client   *net.UDPAddr
+	ip       string
+	queue    chan []byte  // datagrams to the target, nil if denied
+	lastSeen atomic.Int64 // unix nanoseconds of the last packet in either direction
+	bytesIn  atomic.Int64 // not yet in the stats
+	bytesOut atomic.Int64
+}
+
+func openUDPForward(cfg config.Forward) (*udpForward, error) {
+	if cfg.Via != "" {
+		return nil, fmt.Errorf("via is only supported for TCP forwards")
+	}
+	if cfg.IdleTimeout <= 0 {
+		return nil, fmt.Errorf("idle_timeout must be positive")
+	}
+	addr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpForward{Forward: cfg, conn: conn, sessions: make(map[string]*udpSession)}, nil
+}
+
+func (f *udpForward) settings() *config.Forward { return &f.Forward }
+func (f *udpForward) close() error              { return f.conn.Close() }
+
+// serve forwards the datagrams of allowed clients until the socket fails
+func (f *udpForward) serve(h *ProxyHandler) error {
+	go f.expire()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		s := f.session(h, addr)
+		s.lastSeen.Store(time.Now().UnixNano())
+		if s.queue != nil {
+			select {
+			case s.queue <- append([]byte(nil), buf[:n]...):
+			default:
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// session returns the session of addr, opening one if needed. f.mu must be
+// held.
+func (f *udpForward) session(h *ProxyHandler, addr *net.UDPAddr) *udpSession {
+	key := addr.String()
+	if s := f.sessions[key]; s != nil {
+		return s
+	}
+
+	s := &udpSession{client: addr, ip: addr.IP.String()}
+	f.sessions[key] = s
+	if !h.authManager.IsIPAllowedIn(s.ip, forwardNetworks(&f.Forward)) {
+		log.Printf("Forward %s: datagrams from %s denied - not in allowed networks", f.Name, key)
+		stats.LogForward(f.Name, s.ip, 0, 0, true)
+		return s
+	}
+	s.queue = make(chan []byte, udpQueueSize)
+	go f.forward(h, s)
+	return s
+}
+
+// forward connects the socket of s and sends the queued datagrams to the
+// target until the session expires. If the target cannot be reached, the
+// datagrams are dropped until then.
+func (f *udpForward) forward(h *ProxyHandler, s *udpSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Cfg.Outbound.ConnectTimeout)
+	upstream, err := h.dialUDP(ctx, f.Target)
+	cancel()
+	if err != nil {
+		log.Printf("Forward %s: failed to connect to %s: %v", f.Name, f.Target, err)
+		return
+	}
+	defer upstream.Close()
+	log.Printf("Forward %s: %s -> %s (new UDP session)", f.Name, s.client, f.Target)
+	stats.LogForward(f.Name, s.ip, 0, 0, false)
+	go f.reply(s, upstream)
+
+	for datagram := range s.queue {
+		if _, err := upstream.Write(datagram); err == nil {
+			s.bytesIn.Add(int64(len(datagram)))
+		}
+	}
+}
+
+// reply sends the datagrams from the target back to the client of s until
+// the session is closed
+func (f *udpForward) reply(s *udpSession, upstream net.Conn) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := upstream.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// e.g. ICMP port unreachable from the target, the session stays
+			// usable
+			continue
+		}
+		s.lastSeen.Store(time.Now().UnixNano())
+		if _, err := f.conn.WriteToUDP(buf[:n], s.client); err == nil {
+			s.bytesOut.Add(int64(n))
+		}
+	}
+}
+
+// expire periodically moves the traffic of all sessions to the stats and
+// closes sessions idle for longer than the idle timeout
+func (f *udpForward) expire() {
+	interval := min(max(f.IdleTimeout/2, time.Second), 10*time.Second)
+	for range time.Tick(interval) {
+		idleSince := time.Now().Add(-f.IdleTimeout).UnixNano()
+		f.mu.Lock()
+		for key, s := range f.sessions {
+			if in, out := s.bytesIn.Swap(0), s.bytesOut.Swap(0); in > 0 || out > 0 {
+				stats.LogForwardTraffic(f.Name, s.ip, in, out)
+			}
+			if s.lastSeen.Load() >= idleSince {
+				continue
+			}
+			delete(f.sessions, key)
+			if s.queue != nil {
+				close(s.queue) // forward closes the socket
+				log.Printf("Forward %s: UDP session of %s closed after %s idle", f.Name, key, f.IdleTimeout)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+// Package resolver resolves hostnames for outbound connections. It supports
+// DNS servers per domain, static host entries and caches answers for their
+// TTL.
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Options configures a Resolver
+type Options struct {
+	Servers       []string            // default DNS servers, empty = system resolver
+	DomainServers map[string][]string // domain (including subdomains) -> DNS servers
+	Hosts         map[string][]string // static entries host -> addresses
+	Timeout       time.Duration       // per query
+	CacheTTL      time.Duration       // cache duration for system resolver answers
+	MaxTTL        time.Duration       // upper bound for TTLs from DNS answers
+	CAFile        string              // additional root CAs for DoH/DoT servers (PEM)
+}
+
+// maxCacheEntries limits the cache, names can be chosen by clients of the
+// DNS server
+const maxCacheEntries = 10000
+
+// Resolver looks up IP addresses. It is safe for concurrent use.
+type Resolver struct {
+	hosts    map[string][]net.IP
+	servers  []upstream
+	domains  []domainRoute // longest domain first
+	timeout  time.Duration
+	cacheTTL time.Duration
+	maxTTL   time.Duration
+	tls      *tls.Config // for DoH and DoT servers
+
+	mu         sync.Mutex
+	cache      map[string]cacheEntry
+	maxEntries int
+}
+
+type domainRoute struct {
+	domain  string
+	servers []upstream
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// New creates a resolver from opts
+func New(opts Options) (*Resolver, error) {
+	r := &Resolver{
+		hosts:      make(map[string][]net.IP),
+		timeout:    opts.Timeout,
+		cacheTTL:   opts.CacheTTL,
+		maxTTL:     opts.MaxTTL,
+		cache:      make(map[string]cacheEntry),
+		maxEntries: maxCacheEntries,
+	}
+	for host, addrs := range opts.Hosts {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("host %s: invalid address %q", host, addr)
+			}
+			r.hosts[normalize(host)] = append(r.hosts[normalize(host)], ip)
+		}
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+	}
+	r.tls = &tls.Config{RootCAs: roots, ClientSessionCache: tls.NewLRUClientSessionCache(64)}
+
+	if r.servers, err = r.upstreams(opts.Servers); err != nil {
+		return nil, err
+	}
+	for domain, specs := range opts.DomainServers {
+		servers, err := r.upstreams(specs)
+		if err != nil {
+			return nil, fmt.Errorf("domain %s: %w", domain, err)
+		}
+		r.domains = append(r.domains, domainRoute{domain: normalize(domain), servers: servers})
+	}
+	sort.Slice(r.domains, func(i, j int) bool {
+		return len(r.domains[i].domain) > len(r.domains[j].domain)
+	})
+	return r, nil
+}
+
+func (r *Resolver) upstreams(specs []string) ([]upstream, error) {
+	var servers []upstream
+	for _, spec := range specs {
+		u, err := newUpstream(spec, r.timeout, r.tls)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, u)
+	}
+	return servers, nil
+}
+
+// LookupIP returns the addresses of host, IPv4 first
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := normalize(host)
+	if ips, ok := r.hosts[name]; ok {
+		return ips, nil
+	}
+
+	r.mu.Lock()
+	entry, ok := r.cache[name]
+	if ok && !time.Now().Before(entry.expires) {
+		delete(r.cache, name)
+		ok = false
+	}
+	r.mu.Unlock()
+	if ok {
+		return entry.ips, nil
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if servers := r.serversFor(name); len(servers) > 0 {
+		ips, ttl, err = r.query(ctx, servers, name)
+	} else {
+		ips, err = r.lookupSystem(ctx, name)
+		ttl = r.cacheTTL
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	if ttl > 0 {
+		r.store(name, cacheEntry{ips: ips, expires: time.Now().Add(ttl)})
+	}
+	return ips, nil
+}
+
+// store adds an entry to the cache. If the cache is full, expired entries
+// are removed first, then the entry that expires next.
+func (r *Resolver) store(name string, entry cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cache[name]; !ok && len(r.cache) >= r.maxEntries {
+		now := time.Now()
+		var next string
+		for n, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, n)
+			} else if next == "" || e.expires.Before(r.cache[next].expires) {
+				next = n
+			}
+		}
+		if len(r.cache) >= r.maxEntries {
+			delete(r.cache, next)
+		}
+	}
+	r.cache[name] = entry
+}
+
+// ErrNoUpstream is returned by Exchange if name is resolved by the system
+// resolver, which cannot forward raw queries
+var ErrNoUpstream = errors.New("no DNS server configured for this name")
+
+// StaticHost returns the configured static addresses of name
+func (r *Resolver) StaticHost(name string) ([]net.IP, bool) {
+	ips, ok := r.hosts[normalize(name)]
+	return ips, ok
+}
+
+// Exchange forwards a raw query for name to the responsible DNS servers and
+// returns the raw answer of the first server that responds
+func (r *Resolver) Exchange(ctx context.Context, name string, query []byte) ([]byte, error) {
+	servers := r.serversFor(normalize(name))
+	if len(servers) == 0 {
+		return nil, ErrNoUpstream
+	}
+	var lastErr error
+	for _, server := range servers {
+		answer, err := server.exchange(ctx, query)
+		if err == nil {
+			return answer, nil
+		}
+		lastErr = fmt.Errorf("DNS server %s: %w", server, err)
+	}
+	return nil, lastErr
+}
+
+// serversFor returns the DNS servers responsible for name, nil for the
+// system resolver
+func (r *Resolver) serversFor(name string) []upstream {
+	for _, route := range r.domains {
+		if name == route.domain || strings.HasSuffix(name, "."+route.domain) {
+			return route.servers
+		}
+	}
+	return r.servers
+}
+
+func (r *Resolver) lookupSystem(ctx context.Context, name string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	sortIPv4First(ips)
+	return ips, nil
+}
+
+// query asks the servers for A and AAAA records in parallel
+func (r *Resolver) query(ctx context.Context, servers []upstream, name string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]result, len(types))
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &results[i]
+			res.ips, res.ttl, res.err = queryServers(ctx, servers, name, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var ttl uint32
+	var err error
+	for _, res := range results {
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		if len(res.ips) > 0 && (ips == nil || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return nil, 0, err
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// queryServers tries the servers in order until one answers
+func queryServers(ctx context.Context, servers []upstream, name string, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	query, err := buildQuery(name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	for _, server := range servers {
+		answer, err := server.exchange(ctx, query)
+		if err != nil {
+			lastErr = fmt.Errorf("DNS server %s: %w", server, err)
+			continue
+		}
+		return parseAnswer(answer, name)
+	}
+	return nil, 0, lastErr
+}
+
+// buildQuery creates a recursive query with an EDNS0 record for large UDP answers
+func buildQuery(name string, qtype dnsmessage.Type) ([]byte, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseAnswer extracts the A and AAAA records and their lowest TTL
+func parseAnswer(answer []byte, name string) ([]net.IP, uint32, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(answer)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server returned " + header.RCode.String(), Name: name}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			res, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(res.A[:]))
+		case dnsmessage.TypeAAAA:
+			res, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(res.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if len(ips) == 1 || rh.TTL < ttl {
+			ttl = rh.TTL
+		}
+	}
+	return ips, ttl, nil
+}
+
+func sortIPv4First(ips []net.IP) {
+	sort.SliceStable(ips, func(i, j int) bool {
+		return ips[i].To4() != nil && ips[j].To4() == nil
+	})
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,308 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package resolver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohStub is a DNS over HTTPS server answering A queries with a fixed
+// address. It checks the RFC 8484 encoding of every request.
+type dohStub struct {
+	*httptest.Server
+	t       *testing.T
+	ip      [4]byte
+	ttl     uint32
+	status  int          // != 0: answer every request with this HTTP status
+	queries atomic.Int32 // A queries received
+	method  atomic.Value // method of the last request
+}
+
+func newDoHStub(t *testing.T, ip [4]byte, ttl uint32) *dohStub {
+	s := &dohStub{t: t, ip: ip, ttl: ttl}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *dohStub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.status != 0 {
+		http.Error(w, "unavailable", s.status)
+		return
+	}
+	if r.Header.Get("Accept") != "application/dns-message" {
+		s.t.Errorf("Accept = %q", r.Header.Get("Accept"))
+	}
+
+	s.method.Store(r.Method)
+	var query []byte
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != "application/dns-message" {
+			s.t.Errorf("POST Content-Type = %q", ct)
+		}
+		query, err = io.ReadAll(r.Body)
+	case http.MethodGet:
+		// base64url without padding (RFC 8484, section 4.1)
+		query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	default:
+		s.t.Errorf("unexpected method %s", r.Method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		s.t.Errorf("reading %s query: %v", r.Method, err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := s.answer(query)
+	if err != nil {
+		s.t.Errorf("invalid %s query: %v", r.Method, err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(answer)
+}
+
+// answer builds the response to query: the stub address for A questions,
+// no records for other types
+func (s *dohStub) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RecursionDesired: header.RecursionDesired, RecursionAvailable: true})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if q.Type == dnsmessage.TypeA {
+		s.queries.Add(1)
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}, dnsmessage.AResource{A: s.ip})
+	}
+	return b.Finish()
+}
+
+// caFile writes the certificate of the stub servers' test CA to a file for
+// Options.CAFile
+func caFile(t *testing.T, srv *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestResolver(t *testing.T, ca string, servers ...string) *Resolver {
+	t.Helper()
+	r, err := New(Options{Servers: servers, Timeout: 2 * time.Second, MaxTTL: time.Hour, CAFile: ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func lookup(t *testing.T, r *Resolver, host string) string {
+	t.Helper()
+	ips, err := r.LookupIP(context.Background(), host)
+	if err != nil {
+		t.Fatalf("LookupIP(%s): %v", host, err)
+	}
+	if len(ips) != 1 {
+		t.Fatalf("LookupIP(%s) = %v, want one address", host, ips)
+	}
+	return ips[0].String()
+}
+
+func TestDoHEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		suffix string
+	}{
+		{method: http.MethodPost, suffix: "/dns-query"},
+		{method: http.MethodGet, suffix: "/dns-query{?dns}"},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			stub := newDoHStub(t, [4]byte{192, 0, 2, 1}, 300)
+			r := newTestResolver(t, caFile(t, stub.Server), stub.URL+tc.suffix)
+			if got := lookup(t, r, "www.example.com"); got != "192.0.2.1" {
+				t.Errorf("got %s, want 192.0.2.1", got)
+			}
+			if n := stub.queries.Load(); n != 1 {
+				t.Errorf("stub received %d A queries, want 1", n)
+			}
+			if m := stub.method.Load(); m != tc.method {
+				t.Errorf("method = %v, want %s", m, tc.method)
+			}
+		})
+	}
+}
+
+func TestFallbackOrder(t *testing.T) {
+	first := newDoHStub(t, [4]byte{192, 0, 2, 1}, 300)
+	second := newDoHStub(t, [4]byte{192, 0, 2, 2}, 300)
+	ca := caFile(t, first.Server) // httptest servers share one certificate
+
+	// A server nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "https://" + ln.Addr().String() + "/dns-query"
+	ln.Close()
+
+	t.Run("first answers", func(t *testing.T) {
+		r := newTestResolver(t, ca, first.URL, second.URL)
+		if got := lookup(t, r, "a.example.com"); got != "192.0.2.1" {
+			t.Errorf("got %s, want the first server's 192.0.2.1", got)
+		}
+	})
+	t.Run("first fails", func(t *testing.T) {
+		first.status = http.StatusServiceUnavailable
+		defer func() { first.status = 0 }()
+		r := newTestResolver(t, ca, first.URL, second.URL)
+		if got := lookup(t, r, "b.example.com"); got != "192.0.2.2" {
+			t.Errorf("got %s, want the second server's 192.0.2.2", got)
+		}
+	})
+	t.Run("first unreachable", func(t *testing.T) {
+		r := newTestResolver(t, ca, down, second.URL)
+		if got := lookup(t, r, "c.example.com"); got != "192.0.2.2" {
+			t.Errorf("got %s, want the second server's 192.0.2.2", got)
+		}
+	})
+	t.Run("all fail", func(t *testing.T) {
+		r := newTestResolver(t, ca, down)
+		if ips, err := r.LookupIP(context.Background(), "d.example.com"); err == nil {
+			t.Errorf("got %v, want an error", ips)
+		}
+	})
+}
+
+func TestDomainServers(t *testing.T) {
+	public := newDoHStub(t, [4]byte{192, 0, 2, 1}, 300)
+	internal := newDoHStub(t, [4]byte{10, 0, 0, 1}, 300)
+	r, err := New(Options{
+		Servers:       []string{public.URL},
+		DomainServers: map[string][]string{"corp.example.com": {internal.URL}},
+		Hosts:         map[string][]string{"vpn.example.com": {"10.8.0.1"}},
+		Timeout:       2 * time.Second,
+		CAFile:        caFile(t, public.Server),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"www.example.com":      "192.0.2.1",
+		"corp.example.com":     "10.0.0.1",
+		"git.corp.example.com": "10.0.0.1",
+		"VPN.example.com.":     "10.8.0.1",
+		"198.51.100.7":         "198.51.100.7",
+	} {
+		if got := lookup(t, r, host); got != want {
+			t.Errorf("%s: got %s, want %s", host, got, want)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	stub := newDoHStub(t, [4]byte{192, 0, 2, 1}, 300)
+	r := newTestResolver(t, caFile(t, stub.Server), stub.URL)
+
+	lookup(t, r, "www.example.com")
+	lookup(t, r, "WWW.example.com.")
+	if n := stub.queries.Load(); n != 1 {
+		t.Errorf("stub received %d A queries for two lookups, want 1 (cache hit)", n)
+	}
+
+	// An expired entry is queried again
+	r.mu.Lock()
+	entry := r.cache["www.example.com"]
+	entry.expires = time.Now().Add(-time.Second)
+	r.cache["www.example.com"] = entry
+	r.mu.Unlock()
+	lookup(t, r, "www.example.com")
+	if n := stub.queries.Load(); n != 2 {
+		t.Errorf("stub received %d A queries after expiry, want 2", n)
+	}
+
+	// Answers with TTL 0 are not cached
+	stub.ttl = 0
+	lookup(t, r, "nocache.example.com")
+	lookup(t, r, "nocache.example.com")
+	if n := stub.queries.Load(); n != 4 {
+		t.Errorf("stub received %d A queries, want 4 (TTL 0 not cached)", n)
+	}
+}
+
+func TestCacheLimit(t *testing.T) {
+	stub := newDoHStub(t, [4]byte{192, 0, 2, 1}, 300)
+	r := newTestResolver(t, caFile(t, stub.Server), stub.URL)
+	r.maxEntries = 3
+
+	for _, host := range []string{"a.example", "b.example", "c.example"} {
+		lookup(t, r, host)
+	}
+	// b expires next, an expired entry goes first
+	r.mu.Lock()
+	r.cache["a.example"] = cacheEntry{ips: r.cache["a.example"].ips, expires: time.Now().Add(-time.Second)}
+	r.cache["b.example"] = cacheEntry{ips: r.cache["b.example"].ips, expires: time.Now().Add(time.Minute)}
+	r.mu.Unlock()
+
+	lookup(t, r, "d.example")
+	lookup(t, r, "e.example")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) != 3 {
+		t.Errorf("cache has %d entries, want 3", len(r.cache))
+	}
+	for name, want := range map[string]bool{"a.example": false, "b.example": false, "c.example": true, "d.example": true, "e.example": true} {
+		if _, ok := r.cache[name]; ok != want {
+			t.Errorf("%s cached = %v, want %v", name, ok, want)
+		}
+	}
+}
+
+func TestExpiredEntryRemoved(t *testing.T) {
+	stub := newDoHStub(t, [4]byte{192, 0, 2, 1}, 300)
+	r := newTestResolver(t, caFile(t, stub.Server), stub.URL)
+	r.mu.Lock()
+	r.cache["gone.example"] = cacheEntry{expires: time.Now().Add(-time.Second)}
+	r.mu.Unlock()
+
+	stub.status = http.StatusServiceUnavailable
+	if _, err := r.LookupIP(context.Background(), "gone.example"); err == nil {
+		t.Fatal("lookup succeeded, want an error from the failing server")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cache["gone.example"]; ok {
+		t.Error("expired entry is still cached")
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright (c) 2025 Michael Lechner
+This software is released under the MIT License.
+See the LICENSE file for further details.
+*/
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstream sends a raw DNS query to a server and returns the raw answer
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// newUpstream parses a server spec: "10.0.0.53[:port]" for classic DNS,
+// "tls://host[:port]" for DNS over TLS (RFC 7858) and an https:// URL for
+// DNS over HTTPS (RFC 8484). A DoH URL ending in the URI template "{?dns}"
+// is queried with GET, otherwise with POST.
+func newUpstream(spec string, timeout time.Duration, tlsConfig *tls.Config) (upstream, error) {
+	switch {
+	case strings.HasPrefix(spec, "https://"):
+		base, get := strings.CutSuffix(spec, "{?dns}")
+		if _, err := url.Parse(base); err != nil {
+			return nil, fmt.Errorf("DoH server %q: %w", spec, err)
+		}
+		return &dohUpstream{
+			url: base,
+			get: get,
+			client: &http.Client{
+				Timeout: timeout,
+				Transport: &http.Transport{
+					TLSClientConfig:   tlsConfig.Clone(),
+					ForceAttemptHTTP2: true,
+					IdleConnTimeout:   90 * time.Second,
+				},
+			},
+		}, nil
+	case strings.HasPrefix(spec, "tls://"):
+		addr := strings.TrimPrefix(spec, "tls://")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "853")
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		config := tlsConfig.Clone()
+		config.ServerName = host
+		return &dotUpstream{addr: addr, timeout: timeout, tlsConfig: config}, nil
+	}
+
+	addr := spec
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("DNS server %q must be an IP address", spec)
+	}
+	return &udpUpstream{addr: addr, timeout: timeout}, nil
+}
+
+// udpUpstream is a classic DNS server, queried over UDP with a TCP retry for
+// truncated answers
+type udpUpstream struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (u *udpUpstream) String() string {
+	return u.addr
+}
+
+func (u *udpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	answer, err := u.exchangeUDP(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var header dnsmessage.Header
+	var p dnsmessage.Parser
+	if header, err = p.Start(answer); err == nil && header.Truncated {
+		return u.exchangeTCP(ctx, query)
+	}
+	return answer, err
+}
+
+func (u *udpUpstream) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{Timeout: u.timeout}).DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline(ctx, u.timeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not answer our query
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (u *udpUpstream) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{Timeout: u.timeout}).DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline(ctx, u.timeout))
+	return exchangeStream(conn, query)
+}
+
+// dotUpstream is a DNS over TLS server. Sessions are resumed via the
+// session cache of the TLS config.
+type dotUpstream struct {
+	addr      string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+}
+
+func (d *dotUpstream) String() string {
+	return "tls://" + d.addr
+}
+
+func (d *dotUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: d.timeout}, Config: d.tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline(ctx, d.timeout))
+	return exchangeStream(conn, query)
+}
+
+// dohUpstream is a DNS over HTTPS server, queried with POST requests or
+// GET requests carrying the query in the "dns" parameter
+type dohUpstream struct {
+	url    string
+	get    bool
+	client *http.Client
+}
+
+func (d *dohUpstream) String() string {
+	if d.get {
+		return d.url + "{?dns}"
+	}
+	return d.url
+}
+
+func (d *dohUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if d.get {
+		u, _ := url.Parse(d.url)
+		params := u.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		u.RawQuery = params.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(query))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !d.get {
+		req.Header.Set("Content-Type", "application/dns-message")
+	}
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/dns-message" {
+		return nil, fmt.Errorf("DoH server returned unexpected content type %q", ct)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 2 || answer[0] != query[0] || answer[1] != query[1] {
+		return nil, errors.New("DNS answer does not match the query")
+	}
+	return answer, nil
+}
+
+// exchangeStream sends a query with the two byte length prefix used by DNS
+// over TCP and reads one answer
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	if len(answer) < 2 || answer[0] != query[0] || answer[1] != query[1] {
+		return nil, errors.New("DNS answer does not match the query")
+	}
+	return answer, nil
+}
+
+// deadline returns the earlier of the context deadline and now+timeout
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
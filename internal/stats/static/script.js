@@ -59,6 +59,18 @@ function formatDate(timestamp) {
     });
 }
 
+/**
+ * Escapes a string for use in HTML text and attribute values. Hosts, SNI,
+ * paths and client IPs are sent by clients and must never become markup.
+ * @param {*} value - The value to escape
+ * @returns {string} Escaped string
+ */
+function escapeHTML(value) {
+    return String(value ?? '').replace(/[&<>"']/g, c => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+    })[c]);
+}
+
 /**
  * Creates a clone of a template element
  * @param {string} templateId - ID selector of the template to clone
@@ -343,7 +355,7 @@ function groupIdenticalRequests(requests) {
     const grouped = new Map();
     
     requests.forEach(req => {
-        const key = `${req.method}|${req.host}|${req.path}|${req.status}`;
+        const key = `${req.method}|${req.host}|${req.path}|${req.status}|${req.source || ''}`;
         if (!grouped.has(key)) {
             grouped.set(key, {
                 ...req,
@@ -376,13 +388,13 @@ function updateRecentRequests(requests) {
     const groupedRequests = groupIdenticalRequests(requests);
     
     tbody.innerHTML = groupedRequests.map(req => `
-        <tr>
+        <tr${req.source ? ` class="source-${escapeHTML(req.source)}"` : ''}>
             <td>${formatDate(req.timestamp)}</td>
-            <td>${req.client_ip}</td>
-            <td>${req.method}</td>
-            <td>${req.host}</td>
-            <td>${req.path}</td>
-            <td>${req.status}</td>
+            <td${req.listener ? ` title="Listener: ${escapeHTML(req.listener)}"` : ''}>${escapeHTML(req.client_ip)}</td>
+            <td>${escapeHTML(req.method)}</td>
+            <td${req.dns_ms ? ` title="DNS: ${escapeHTML(req.dns_ms)} ms"` : ''}>${escapeHTML(req.host)}${req.sni && !req.host.startsWith(req.sni) ? ` <small>(SNI: ${escapeHTML(req.sni)})</small>` : ''}</td>
+            <td>${escapeHTML(req.path)}</td>
+            <td>${escapeHTML(req.status)}${req.source ? ` <small class="source">(${escapeHTML(req.source)})</small>` : ''}</td>
             <td>${formatBytes(req.bytes_total)}</td>            <td>${req.count > 1 ? `<small>${req.count}×</small>` : ''}</td>
         </tr>
     `).join('');
@@ -398,11 +410,11 @@ function updateClientStats(clients) {
 
     tbody.innerHTML = clients.map(client => `
         <tr>
-            <td>${client.ip}</td>
+            <td>${escapeHTML(client.ip)}</td>
             <td>${formatBytes(client.bytes_in)}</td>
             <td>${formatBytes(client.bytes_out)}</td>
             <td>${formatBytes(client.bytes_total)}</td>
-            <td>${client.requests}</td>
+            <td>${client.requests}${client.dns_queries ? ` <small title="DNS">(DNS: ${client.dns_queries}${client.dns_blocked ? `, ${client.dns_blocked} blocked` : ''})</small>` : ''}</td>
             <td>${formatDate(client.last_seen)}</td>
         </tr>
     `).join('');
@@ -8,6 +8,7 @@ See the LICENSE file for further details.
 package stats
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"mlc_goproxy/internal/config"
@@ -66,6 +67,19 @@ type RequestInfo struct {
 	Status    int       `json:"status"`
 	BytesIn   int64     `json:"bytes_in"`
 	BytesOut  int64     `json:"bytes_out"`
+	SNI       string    `json:"sni,omitempty"`
+	ALPN      string    `json:"alpn,omitempty"`
+	Source    string    `json:"source,omitempty"` // leer = Upstream, sonst z.B. "replay"
+	DNSTime   float64   `json:"dns_ms,omitempty"` // Dauer der Namensauflösung in Millisekunden
+	Listener  string    `json:"listener,omitempty"`
+}
+
+// RequestDetails enthält optionale Zusatzinformationen zu einer Anfrage
+type RequestDetails struct {
+	SNI    string        // Server Name aus dem TLS ClientHello eines CONNECT-Tunnels
+	ALPN   []string      // vom Client angebotene ALPN-Protokolle
+	Source string        // Herkunft der Antwort, falls nicht vom Upstream (z.B. "replay")
+	DNS    time.Duration // Dauer der Namensauflösung, 0 = keine (z.B. wiederverwendete Verbindung)
 }
 
 type ClientStats struct {
@@ -75,17 +89,37 @@ type ClientStats struct {
 	BytesTotal int64     `json:"bytes_total"`
 	Requests   int       `json:"requests"`
 	LastSeen   time.Time `json:"last_seen"`
+	DNSQueries int64     `json:"dns_queries,omitempty"`
+	DNSBlocked int64     `json:"dns_blocked,omitempty"`
+}
+
+// ListenerStats enthält die Zähler eines Proxy-Listeners
+type ListenerStats struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// ForwardStats enthält die Zähler einer Portweiterleitung
+type ForwardStats struct {
+	Connections int64 `json:"connections"`
+	Denied      int64 `json:"denied"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
 }
 
 type Stats struct {
 	mu             sync.RWMutex
-	StartTime      time.Time               `json:"start_time"`
-	TotalRequests  int64                   `json:"total_requests"`
-	TotalBytesIn   int64                   `json:"total_bytes_in"`
-	TotalBytesOut  int64                   `json:"total_bytes_out"`
-	ActiveClients  int                     `json:"active_clients"`
-	ClientStats    map[string]*ClientStats `json:"-"`
-	RecentRequests []RequestInfo           `json:"-"`
+	StartTime      time.Time                 `json:"start_time"`
+	TotalRequests  int64                     `json:"total_requests"`
+	TotalBytesIn   int64                     `json:"total_bytes_in"`
+	TotalBytesOut  int64                     `json:"total_bytes_out"`
+	ActiveClients  int                       `json:"active_clients"`
+	ClientStats    map[string]*ClientStats   `json:"-"`
+	RecentRequests []RequestInfo             `json:"-"`
+	BlockedByList  map[string]int64          `json:"blocked_by_list,omitempty"`
+	Listeners      map[string]*ListenerStats `json:"listeners,omitempty"`
+	Forwards       map[string]*ForwardStats  `json:"forwards,omitempty"`
 }
 
 var globalStats = New()
@@ -100,10 +134,25 @@ func New() *Stats {
 		StartTime:      time.Now(),
 		ClientStats:    make(map[string]*ClientStats),
 		RecentRequests: make([]RequestInfo, 0, 100),
+		BlockedByList:  make(map[string]int64),
+		Listeners:      make(map[string]*ListenerStats),
+		Forwards:       make(map[string]*ForwardStats),
 	}
 }
 
+type listenerKey struct{}
+
+// WithListener ordnet Anfragen mit dem Kontext ctx dem Listener name zu
+func WithListener(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, listenerKey{}, name)
+}
+
 func LogRequest(req *http.Request, status int, bytesIn, bytesOut int64) {
+	LogRequestDetails(req, status, bytesIn, bytesOut, RequestDetails{})
+}
+
+// LogRequestDetails protokolliert eine Anfrage mit Zusatzinformationen
+func LogRequestDetails(req *http.Request, status int, bytesIn, bytesOut int64, details RequestDetails) {
 	globalStats.mu.Lock()
 	defer globalStats.mu.Unlock()
 
@@ -138,6 +187,23 @@ func LogRequest(req *http.Request, status int, bytesIn, bytesOut int64) {
 		Status:    status,
 		BytesIn:   bytesIn,
 		BytesOut:  bytesOut,
+		SNI:       details.SNI,
+		ALPN:      strings.Join(details.ALPN, ","),
+		Source:    details.Source,
+		DNSTime:   float64(details.DNS.Microseconds()) / 1000,
+	}
+
+	// Zähler pro Listener
+	if name, ok := req.Context().Value(listenerKey{}).(string); ok {
+		l, exists := globalStats.Listeners[name]
+		if !exists {
+			l = &ListenerStats{}
+			globalStats.Listeners[name] = l
+		}
+		l.Requests++
+		l.BytesIn += bytesIn
+		l.BytesOut += bytesOut
+		reqInfo.Listener = name
 	}
 
 	if len(globalStats.RecentRequests) >= 100 {
@@ -153,6 +219,84 @@ func LogRequest(req *http.Request, status int, bytesIn, bytesOut int64) {
 	globalStats.TotalBytesOut += bytesOut
 }
 
+// LogBlocked zählt eine durch die Blockliste list abgewiesene Anfrage
+func LogBlocked(list string) {
+	globalStats.mu.Lock()
+	defer globalStats.mu.Unlock()
+
+	globalStats.BlockedByList[list]++
+}
+
+// LogDNSQuery zählt eine Anfrage an den DNS-Server pro Client
+func LogDNSQuery(ip string, blocked bool) {
+	globalStats.mu.Lock()
+	defer globalStats.mu.Unlock()
+
+	client, exists := globalStats.ClientStats[ip]
+	if !exists {
+		client = &ClientStats{IP: ip}
+		globalStats.ClientStats[ip] = client
+	}
+	client.DNSQueries++
+	if blocked {
+		client.DNSBlocked++
+	}
+	client.LastSeen = time.Now()
+	globalStats.updateActiveClients()
+}
+
+// LogForward zählt eine beendete Verbindung der Portweiterleitung name.
+// Die Bytes werden auch dem Client ip zugerechnet.
+func LogForward(name, ip string, bytesIn, bytesOut int64, denied bool) {
+	globalStats.mu.Lock()
+	defer globalStats.mu.Unlock()
+
+	f := globalStats.forward(name)
+	if denied {
+		f.Denied++
+		return
+	}
+	f.Connections++
+	globalStats.logForwardTraffic(f, ip, bytesIn, bytesOut)
+}
+
+// LogForwardTraffic rechnet Bytes einer laufenden Sitzung der
+// Portweiterleitung name zu, ohne eine Verbindung zu zählen
+func LogForwardTraffic(name, ip string, bytesIn, bytesOut int64) {
+	globalStats.mu.Lock()
+	defer globalStats.mu.Unlock()
+
+	globalStats.logForwardTraffic(globalStats.forward(name), ip, bytesIn, bytesOut)
+}
+
+func (s *Stats) forward(name string) *ForwardStats {
+	f, exists := s.Forwards[name]
+	if !exists {
+		f = &ForwardStats{}
+		s.Forwards[name] = f
+	}
+	return f
+}
+
+func (s *Stats) logForwardTraffic(f *ForwardStats, ip string, bytesIn, bytesOut int64) {
+	f.BytesIn += bytesIn
+	f.BytesOut += bytesOut
+
+	client, exists := s.ClientStats[ip]
+	if !exists {
+		client = &ClientStats{IP: ip}
+		s.ClientStats[ip] = client
+	}
+	client.BytesIn += bytesIn
+	client.BytesOut += bytesOut
+	client.BytesTotal = client.BytesIn + client.BytesOut
+	client.LastSeen = time.Now()
+	s.updateActiveClients()
+
+	s.TotalBytesIn += bytesIn
+	s.TotalBytesOut += bytesOut
+}
+
 func LogTransfer(ip string, bytesIn, bytesOut uint64) {
 	globalStats.mu.Lock()
 	defer globalStats.mu.Unlock()